@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Backplane relays room traffic, presence and state ownership between backend
+// nodes so clients of the same room can connect to different replicas
+type Backplane interface {
+	// Publish sends a room broadcast to every node subscribed to the room
+	Publish(roomID string, data []byte) error
+	// Subscribe calls deliver for each broadcast published to the room until unsubscribed
+	Subscribe(roomID string, deliver func(data []byte)) (unsubscribe func(), err error)
+	// SetPresence records the users connected to this node, expiring after ttl
+	SetPresence(roomID, nodeID string, users []UserInfo, ttl time.Duration) error
+	// Presence returns the users connected to the room across all nodes
+	Presence(roomID string) ([]UserInfo, error)
+	// ClaimOwner makes nodeID the room's state owner for ttl unless another
+	// node already holds it, and reports whether nodeID owns the room
+	ClaimOwner(roomID, nodeID string, ttl time.Duration) (bool, error)
+	// SaveRoom, LoadRoom and DeleteRoom manage the shared room directory
+	SaveRoom(roomID string, data []byte) error
+	LoadRoom(roomID string) ([]byte, error)
+	DeleteRoom(roomID string) error
+}
+
+const (
+	// presenceTTL is how long a node's presence entry lives without a refresh
+	presenceTTL = 30 * time.Second
+	// ownerTTL is how long a node holds room ownership without a refresh
+	ownerTTL = 30 * time.Second
+)
+
+var (
+	// backplane relays room traffic between nodes; in-process unless configured
+	backplane Backplane = newMemoryBackplane()
+	// nodeID identifies this backend process on the backplane
+	nodeID = uuid.New().String()[:8]
+)
+
+// OpenBackplane configures the backplane from the environment. BACKPLANE_REDIS_URL
+// selects the Redis backplane, and NODE_ID overrides the generated node ID.
+func OpenBackplane() error {
+	if id := os.Getenv("NODE_ID"); id != "" {
+		nodeID = id
+	}
+
+	url := os.Getenv("BACKPLANE_REDIS_URL")
+	if url == "" {
+		return nil
+	}
+
+	rb, err := newRedisBackplane(url)
+	if err != nil {
+		return err
+	}
+	backplane = rb
+	log.Printf("Using Redis backplane as node %s", nodeID)
+	return nil
+}
+
+// backplaneEnvelope wraps a published broadcast with the node it came from
+type backplaneEnvelope struct {
+	Node string          `json:"node"`
+	Data json.RawMessage `json:"data"`
+}
+
+// attachBackplane subscribes the room to broadcasts from other nodes
+func (room *Room) attachBackplane() {
+	unsubscribe, err := backplane.Subscribe(room.ID, func(data []byte) {
+		var env backplaneEnvelope
+		if err := json.Unmarshal(data, &env); err != nil || env.Node == nodeID {
+			return
+		}
+
+		select {
+		case room.Remote <- env.Data:
+		default:
+			log.Printf("Room %s: dropped backplane message (buffer full)", room.ID)
+		}
+	})
+	if err != nil {
+		log.Printf("Room %s: backplane subscribe failed: %v", room.ID, err)
+		return
+	}
+
+	room.unsubscribe = unsubscribe
+	room.claimOwnership()
+}
+
+// detachBackplane cancels the room's backplane subscription and withdraws
+// this node's presence
+func (room *Room) detachBackplane() {
+	if room.unsubscribe != nil {
+		room.unsubscribe()
+		room.unsubscribe = nil
+	}
+	backplane.SetPresence(room.ID, nodeID, []UserInfo{}, time.Millisecond)
+}
+
+// publish sends a local broadcast to the other nodes
+func (room *Room) publish(message []byte) {
+	env := mustMarshal(backplaneEnvelope{Node: nodeID, Data: message})
+	if err := backplane.Publish(room.ID, env); err != nil {
+		log.Printf("Room %s: backplane publish failed: %v", room.ID, err)
+	}
+}
+
+// claimOwnership refreshes whether this node owns the room's shared state.
+// Replay rooms live on one node and are never persisted, so they own nothing.
+func (room *Room) claimOwnership() {
+	if room.ReplayOf != "" {
+		return
+	}
+
+	owner, err := backplane.ClaimOwner(room.ID, nodeID, ownerTTL)
+	if err != nil {
+		log.Printf("Room %s: ownership claim failed: %v", room.ID, err)
+		return
+	}
+	if owner != room.owner {
+		log.Printf("Room %s: node %s owner=%v", room.ID, nodeID, owner)
+	}
+	room.owner = owner
+}
+
+// localUsers lists the users connected to this node, including resumable ones
+func (room *Room) localUsers() []UserInfo {
+	users := make([]UserInfo, 0, len(room.Clients))
+	for client := range room.Clients {
+		users = append(users, UserInfo{
+			ID:       client.ID,
+			Username: client.Username,
+			Role:     client.Role,
+		})
+	}
+	return append(users, room.awayUsers()...)
+}
+
+// presence publishes this node's users and returns the room's users across all nodes
+func (room *Room) presence() []UserInfo {
+	local := room.localUsers()
+	if err := backplane.SetPresence(room.ID, nodeID, local, presenceTTL); err != nil {
+		log.Printf("Room %s: presence update failed: %v", room.ID, err)
+		return local
+	}
+
+	users, err := backplane.Presence(room.ID)
+	if err != nil {
+		log.Printf("Room %s: presence lookup failed: %v", room.ID, err)
+		return local
+	}
+	return users
+}
+
+// deliver sends a message to every client connected to this node. Clients
+// that fall behind are handled by checkSlowConsumers.
+func (room *Room) deliver(message []byte) {
+	room.deliverFrame(newFrame(message))
+}
+
+// deliverFrame sends an encoded message to every client connected to this node
+func (room *Room) deliverFrame(f *frame) {
+	for client := range room.Clients {
+		client.enqueue(f)
+	}
+}
+
+// applyRemote updates the local replica from another node's broadcast and
+// delivers it to the clients on this node
+func (room *Room) applyRemote(data []byte) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Room %s: invalid backplane message: %v", room.ID, err)
+		return
+	}
+
+	// Targeted messages (WebRTC signaling) only go to their recipient
+	if msg.To != "" {
+		for client := range room.Clients {
+			if client.ID == msg.To {
+				client.send(data)
+			}
+		}
+		return
+	}
+
+	switch msg.Type {
+	case MessageTypePlay, MessageTypePause:
+		var payload PlayPauseData
+		json.Unmarshal(msg.Data, &payload)
+		room.VideoState.IsPlaying = msg.Type == MessageTypePlay
+		if !room.VideoState.Live {
+			room.VideoState.CurrentTime = payload.CurrentTime
+		}
+		room.VideoState.LastUpdateBy = msg.Username
+		room.VideoState.UpdatedAt = time.Now()
+		room.markDirty()
+
+	case MessageTypeSeek:
+		var payload SeekData
+		json.Unmarshal(msg.Data, &payload)
+		room.VideoState.CurrentTime = payload.Time
+		room.VideoState.LastUpdateBy = msg.Username
+		room.VideoState.UpdatedAt = time.Now()
+		room.markDirty()
+
+	case MessageTypeSync:
+		var payload SyncData
+		json.Unmarshal(msg.Data, &payload)
+		if payload.VideoState != nil {
+			room.VideoState = payload.VideoState
+		}
+		room.setNowPlaying(payload.NowPlaying)
+		room.Queue = payload.Queue
+		room.markDirty()
+
+	case MessageTypeQueue:
+		var payload QueueData
+		json.Unmarshal(msg.Data, &payload)
+		room.setNowPlaying(payload.NowPlaying)
+		room.Queue = payload.Queue
+		room.markDirty()
+
+	case MessageTypeChat, MessageTypeChatEdit, MessageTypeChatDelete, MessageTypeChatReact:
+		room.storeRemoteChat(msg)
+
+	case MessageTypeRole:
+		var payload RoleData
+		json.Unmarshal(msg.Data, &payload)
+		room.applyRole(payload.UserID, payload.Role)
+		room.presence()
+
+	case MessageTypeMediaJoin, MessageTypeMediaLeave:
+		room.applyRemoteMedia(msg)
+
+	case MessageTypeShareStart, MessageTypeShareStop:
+		room.applyRemoteShare(msg)
+
+	case MessageTypeRoomClosed:
+		// The host closed the room on another node
+		var payload RoomClosedData
+		json.Unmarshal(msg.Data, &payload)
+		room.shutdown(payload.Reason, false)
+		forgetRoom(room)
+		return
+	}
+
+	room.LastActivity = time.Now()
+	f := newFrame(data)
+	f.seq = room.History.push(data)
+	room.recordEvent(EventBroadcast, nil, data)
+	room.deliverFrame(f)
+}
+
+// setNowPlaying updates the current item and the movie or URL it points to
+func (room *Room) setNowPlaying(item *QueueItem) {
+	if item == nil || room.NowPlaying == nil || item.ID != room.NowPlaying.ID {
+		room.endedReports = nil
+	}
+	room.NowPlaying = item
+	if item != nil {
+		room.MovieID = item.MovieID
+		room.CustomVideoURL = item.CustomVideoURL
+	}
+}
+
+// storeRemoteChat keeps chat from other nodes in the in-memory history so
+// clients joining this node see it too
+func (room *Room) storeRemoteChat(msg Message) {
+	room.chatMutex.Lock()
+	defer room.chatMutex.Unlock()
+
+	for i := range room.Chat {
+		if room.Chat[i].ID == msg.ID {
+			room.Chat[i].Data = msg.Data
+			return
+		}
+	}
+	if msg.Type != MessageTypeChat {
+		return
+	}
+
+	room.Chat = append(room.Chat, msg)
+	if len(room.Chat) > maxChatHistory {
+		room.Chat = room.Chat[len(room.Chat)-maxChatHistory:]
+	}
+}
+
+// lookupRoom finds a room on this node, or creates a local replica of a room
+// that another node registered on the backplane
+func lookupRoom(roomID string) (*Room, bool) {
+	roomsMutex.RLock()
+	room, exists := rooms[roomID]
+	roomsMutex.RUnlock()
+	if exists {
+		return room, true
+	}
+
+	data, err := backplane.LoadRoom(roomID)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("Room %s: backplane lookup failed: %v", roomID, err)
+		}
+		return nil, false
+	}
+
+	var record roomRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		log.Printf("Room %s: invalid backplane record: %v", roomID, err)
+		return nil, false
+	}
+
+	room = roomFromRecord(record)
+	room.attachBackplane()
+
+	roomsMutex.Lock()
+	if existing, ok := rooms[roomID]; ok {
+		roomsMutex.Unlock()
+		room.detachBackplane()
+		return existing, true
+	}
+	room.Start()
+	rooms[roomID] = room
+	roomsMutex.Unlock()
+
+	log.Printf("Room %s: joined from backplane", roomID)
+	return room, true
+}
+
+// memoryBackplane is the in-process Backplane used for a single node
+type memoryBackplane struct {
+	mu          sync.Mutex
+	subscribers map[string]map[int]func([]byte)
+	nextID      int
+	presence    map[string]map[string]memoryPresence
+	owners      map[string]memoryOwner
+	rooms       map[string][]byte
+}
+
+type memoryPresence struct {
+	users   []UserInfo
+	expires time.Time
+}
+
+type memoryOwner struct {
+	node    string
+	expires time.Time
+}
+
+func newMemoryBackplane() *memoryBackplane {
+	return &memoryBackplane{
+		subscribers: make(map[string]map[int]func([]byte)),
+		presence:    make(map[string]map[string]memoryPresence),
+		owners:      make(map[string]memoryOwner),
+		rooms:       make(map[string][]byte),
+	}
+}
+
+func (b *memoryBackplane) Publish(roomID string, data []byte) error {
+	b.mu.Lock()
+	subscribers := make([]func([]byte), 0, len(b.subscribers[roomID]))
+	for _, deliver := range b.subscribers[roomID] {
+		subscribers = append(subscribers, deliver)
+	}
+	b.mu.Unlock()
+
+	for _, deliver := range subscribers {
+		deliver(data)
+	}
+	return nil
+}
+
+func (b *memoryBackplane) Subscribe(roomID string, deliver func(data []byte)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers[roomID] == nil {
+		b.subscribers[roomID] = make(map[int]func([]byte))
+	}
+	id := b.nextID
+	b.nextID++
+	b.subscribers[roomID][id] = deliver
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subscribers[roomID], id)
+		if len(b.subscribers[roomID]) == 0 {
+			delete(b.subscribers, roomID)
+		}
+		b.mu.Unlock()
+	}, nil
+}
+
+func (b *memoryBackplane) SetPresence(roomID, nodeID string, users []UserInfo, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.presence[roomID] == nil {
+		b.presence[roomID] = make(map[string]memoryPresence)
+	}
+	b.presence[roomID][nodeID] = memoryPresence{users: users, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (b *memoryBackplane) Presence(roomID string) ([]UserInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	users := make([]UserInfo, 0)
+	for node, entry := range b.presence[roomID] {
+		if time.Now().After(entry.expires) {
+			delete(b.presence[roomID], node)
+			continue
+		}
+		users = append(users, entry.users...)
+	}
+	return users, nil
+}
+
+func (b *memoryBackplane) ClaimOwner(roomID, nodeID string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, ok := b.owners[roomID]
+	if ok && current.node != nodeID && time.Now().Before(current.expires) {
+		return false, nil
+	}
+	b.owners[roomID] = memoryOwner{node: nodeID, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (b *memoryBackplane) SaveRoom(roomID string, data []byte) error {
+	b.mu.Lock()
+	b.rooms[roomID] = data
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBackplane) LoadRoom(roomID string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, ok := b.rooms[roomID]
+	if !ok {
+		return nil, errNotFound
+	}
+	return data, nil
+}
+
+func (b *memoryBackplane) DeleteRoom(roomID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.rooms, roomID)
+	delete(b.presence, roomID)
+	delete(b.owners, roomID)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces every key and channel the backplane uses
+const redisKeyPrefix = "movieapp:"
+
+// redisBackplane is a Backplane backed by Redis pub/sub and keys. It works
+// with any server that speaks the Redis protocol.
+type redisBackplane struct {
+	client *redis.Client
+}
+
+func newRedisBackplane(url string) (*redisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis ping: %v", err)
+	}
+
+	return &redisBackplane{client: client}, nil
+}
+
+func roomChannel(roomID string) string    { return redisKeyPrefix + "room:" + roomID + ":events" }
+func roomKey(roomID string) string        { return redisKeyPrefix + "room:" + roomID }
+func ownerKey(roomID string) string       { return redisKeyPrefix + "room:" + roomID + ":owner" }
+func presenceSetKey(roomID string) string { return redisKeyPrefix + "room:" + roomID + ":nodes" }
+func presenceKey(roomID, nodeID string) string {
+	return redisKeyPrefix + "room:" + roomID + ":presence:" + nodeID
+}
+
+func (b *redisBackplane) Publish(roomID string, data []byte) error {
+	return b.client.Publish(context.Background(), roomChannel(roomID), data).Err()
+}
+
+func (b *redisBackplane) Subscribe(roomID string, deliver func(data []byte)) (func(), error) {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, roomChannel(roomID))
+
+	// Wait for the subscription to be confirmed so no broadcast is missed after returning
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			deliver([]byte(msg.Payload))
+		}
+	}()
+
+	return func() { pubsub.Close() }, nil
+}
+
+func (b *redisBackplane) SetPresence(roomID, nodeID string, users []UserInfo, ttl time.Duration) error {
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	pipe := b.client.TxPipeline()
+	pipe.Set(ctx, presenceKey(roomID, nodeID), data, ttl)
+	pipe.SAdd(ctx, presenceSetKey(roomID), nodeID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (b *redisBackplane) Presence(roomID string) ([]UserInfo, error) {
+	ctx := context.Background()
+	nodes, err := b.client.SMembers(ctx, presenceSetKey(roomID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]UserInfo, 0)
+	for _, node := range nodes {
+		data, err := b.client.Get(ctx, presenceKey(roomID, node)).Bytes()
+		if err == redis.Nil {
+			// The node's entry expired, so it has left or died
+			b.client.SRem(ctx, presenceSetKey(roomID), node)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var nodeUsers []UserInfo
+		if err := json.Unmarshal(data, &nodeUsers); err != nil {
+			return nil, err
+		}
+		users = append(users, nodeUsers...)
+	}
+	return users, nil
+}
+
+// claimOwnerScript takes a room's ownership when it is free, or extends it
+// when nodeID already holds it, in one step so no other node's claim can land
+// in between
+var claimOwnerScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if owner == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+func (b *redisBackplane) ClaimOwner(roomID, nodeID string, ttl time.Duration) (bool, error) {
+	claimed, err := claimOwnerScript.Run(context.Background(), b.client, []string{ownerKey(roomID)}, nodeID, ttl.Milliseconds()).Int()
+	return claimed == 1, err
+}
+
+func (b *redisBackplane) SaveRoom(roomID string, data []byte) error {
+	return b.client.Set(context.Background(), roomKey(roomID), data, 0).Err()
+}
+
+func (b *redisBackplane) LoadRoom(roomID string) ([]byte, error) {
+	data, err := b.client.Get(context.Background(), roomKey(roomID)).Bytes()
+	if err == redis.Nil {
+		return nil, errNotFound
+	}
+	return data, err
+}
+
+func (b *redisBackplane) DeleteRoom(roomID string) error {
+	return b.client.Del(context.Background(), roomKey(roomID), ownerKey(roomID), presenceSetKey(roomID)).Err()
+}
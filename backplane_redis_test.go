@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+// connectRedis opens a Redis backplane on the stand-in server
+func connectRedis(t *testing.T, mr *miniredis.Miniredis) *redisBackplane {
+	t.Helper()
+
+	rb, err := newRedisBackplane("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("connect to redis: %v", err)
+	}
+	t.Cleanup(func() { rb.client.Close() })
+	return rb
+}
+
+// TestRedisClaimOwner checks only one node owns a room until its claim expires
+func TestRedisClaimOwner(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := connectRedis(t, mr)
+	b := connectRedis(t, mr)
+
+	claim := func(rb *redisBackplane, node string, want bool) {
+		t.Helper()
+		owner, err := rb.ClaimOwner("room1", node, ownerTTL)
+		if err != nil {
+			t.Fatalf("claim by %s: %v", node, err)
+		}
+		if owner != want {
+			t.Fatalf("claim by %s: owner=%v, want %v", node, owner, want)
+		}
+	}
+
+	claim(a, "a", true)
+	claim(b, "b", false)
+
+	// Refreshing keeps the claim alive past the original expiry
+	mr.FastForward(ownerTTL / 2)
+	claim(a, "a", true)
+	mr.FastForward(ownerTTL * 3 / 4)
+	claim(b, "b", false)
+
+	mr.FastForward(ownerTTL)
+	claim(b, "b", true)
+	claim(a, "a", false)
+}
+
+// TestRedisBackplaneCrossNode relays play and chat between a client on this
+// node and another node on the same Redis
+func TestRedisBackplaneCrossNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	previous := backplane
+	backplane = connectRedis(t, mr)
+	t.Cleanup(func() { backplane = previous })
+
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	// The other node sees this node's broadcasts on the room channel
+	peer := connectRedis(t, mr)
+	received := make(chan backplaneEnvelope, 64)
+	unsubscribe, err := peer.Subscribe(room.ID, func(data []byte) {
+		var env backplaneEnvelope
+		json.Unmarshal(data, &env)
+		received <- env
+	})
+	if err != nil {
+		t.Fatalf("peer subscribe: %v", err)
+	}
+	defer unsubscribe()
+
+	conn, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, MessageTypeSync)
+
+	// Play on the other node reaches the client here
+	peerPublish := func(msg Message) {
+		t.Helper()
+		env := mustMarshal(backplaneEnvelope{Node: "peer", Data: mustMarshal(msg)})
+		if err := peer.Publish(room.ID, env); err != nil {
+			t.Fatalf("peer publish: %v", err)
+		}
+	}
+	peerPublish(Message{
+		Type:     MessageTypePlay,
+		RoomID:   room.ID,
+		UserID:   "bob1",
+		Username: "bob",
+		Data:     mustMarshal(PlayPauseData{CurrentTime: 42}),
+	})
+	play := readUntil(t, conn, MessageTypePlay)
+	var playData PlayPauseData
+	json.Unmarshal(play.Data, &playData)
+	if play.Username != "bob" || playData.CurrentTime != 42 {
+		t.Fatalf("play from peer arrived as %+v", play)
+	}
+
+	// Chat from the other node reaches the client here
+	peerPublish(Message{
+		ID:       "chat1",
+		Type:     MessageTypeChat,
+		RoomID:   room.ID,
+		UserID:   "bob1",
+		Username: "bob",
+		Data:     mustMarshal(ChatData{Message: "hi from bob"}),
+	})
+	chat := readUntil(t, conn, MessageTypeChat)
+	if chat.ID != "chat1" || chat.Username != "bob" {
+		t.Fatalf("chat from peer arrived as %+v", chat)
+	}
+
+	// Chat from the client here reaches the other node
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"hi from alice"}}`))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case env := <-received:
+			var msg Message
+			json.Unmarshal(env.Data, &msg)
+			if msg.Type != MessageTypeChat || msg.Username != "alice" {
+				continue
+			}
+			if env.Node != nodeID {
+				t.Fatalf("chat published as node %q, want %q", env.Node, nodeID)
+			}
+			var data ChatData
+			json.Unmarshal(msg.Data, &data)
+			if data.Message != "hi from alice" {
+				t.Fatalf("chat reached peer as %q", data.Message)
+			}
+			return
+		case <-timeout:
+			t.Fatal("chat never reached the other node")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// slowConsumerTimeout is how long a client's Send channel may stay full
+	// without draining before the client is disconnected
+	slowConsumerTimeout = 15 * time.Second
+	// maxBacklog caps the messages held for a client whose Send channel is full
+	maxBacklog = 512
+)
+
+// How a message is treated when a client falls behind
+const (
+	deliverNormal    = iota // Held in order until the client catches up
+	deliverLatest           // Only the newest message of the type is held
+	deliverDroppable        // Dropped while the client is behind
+)
+
+// deliveryClasses lists the message types that are not held in full. State
+// messages are superseded by the next one of their type; transient messages
+// are worthless once late.
+var deliveryClasses = map[string]int{
+	MessageTypeSync:        deliverLatest,
+	MessageTypeUserList:    deliverLatest,
+	MessageTypeQueue:       deliverLatest,
+	MessageTypeCountdown:   deliverLatest,
+	MessageTypeVoteUpdate:  deliverLatest,
+	MessageTypeReadyUpdate: deliverLatest,
+	MessageTypeReactions:   deliverDroppable,
+	MessageTypeTyping:      deliverDroppable,
+	MessageTypeComments:    deliverDroppable,
+}
+
+// outgoing is an encoded message on its way to a client's connection
+type outgoing struct {
+	msgType string
+	seq     uint64
+	data    []byte
+}
+
+// messageType returns the type of an encoded message
+func messageType(message []byte) string {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(message, &envelope)
+	return envelope.Type
+}
+
+// send queues a message for this client only. It must be called from Run.
+func (c *Client) send(message []byte) {
+	c.enqueue(newFrame(message))
+}
+
+// enqueue hands a message to the client's writer, or holds it while the
+// client's Send channel is full. Held state messages replace older ones of
+// the same type and transient messages are dropped, so a client that catches
+// up gets the current state rather than everything it missed.
+func (c *Client) enqueue(f *frame) {
+	out := outgoing{msgType: f.msgType, seq: f.seq, data: f.encode(c.protocol)}
+	c.flushBacklog()
+	if len(c.backlog) == 0 {
+		select {
+		case c.Send <- out:
+			return
+		default:
+			c.stalledSince = time.Now()
+		}
+	}
+
+	switch deliveryClasses[out.msgType] {
+	case deliverDroppable:
+		return
+	case deliverLatest:
+		for i, held := range c.backlog {
+			if held.msgType == out.msgType {
+				c.backlog = append(c.backlog[:i], c.backlog[i+1:]...)
+				break
+			}
+		}
+	}
+	c.backlog = append(c.backlog, out)
+}
+
+// flushBacklog moves held messages into the Send channel as it drains. A
+// client still behind whose writer made progress is not stalled, so its
+// timeout starts over.
+func (c *Client) flushBacklog() {
+	progressed := false
+	for len(c.backlog) > 0 {
+		select {
+		case c.Send <- c.backlog[0]:
+			c.backlog[0] = outgoing{}
+			c.backlog = c.backlog[1:]
+			progressed = true
+		default:
+			if progressed {
+				c.stalledSince = time.Now()
+			}
+			return
+		}
+	}
+	c.backlog = nil
+	c.stalledSince = time.Time{}
+}
+
+// checkSlowConsumers flushes held messages and disconnects clients that have
+// not kept up for slowConsumerTimeout, or have fallen too far behind. Their
+// session stays resumable, so a client on a poor connection can come back.
+func (room *Room) checkSlowConsumers() {
+	for client := range room.Clients {
+		if len(client.backlog) == 0 {
+			continue
+		}
+		client.flushBacklog()
+		if len(client.backlog) == 0 {
+			continue
+		}
+
+		if len(client.backlog) > maxBacklog || time.Since(client.stalledSince) > slowConsumerTimeout {
+			log.Printf("Room %s: disconnecting slow client %s (%d messages behind)", room.ID, client.Username, len(client.backlog))
+			client.backlog = nil
+			room.disconnect(client, websocket.CloseTryAgainLater, "Connection too slow")
+		}
+	}
+}
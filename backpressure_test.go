@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBacklogProgressResetsStall checks a slow client whose Send channel
+// still drains is not treated as stalled for the whole time it is behind
+func TestBacklogProgressResetsStall(t *testing.T) {
+	c := &Client{Send: make(chan outgoing, 1), protocol: ProtocolJSON}
+	for i := 0; i < 3; i++ {
+		c.send([]byte(`{"type":"chat"}`))
+	}
+	if len(c.backlog) != 2 || c.stalledSince.IsZero() {
+		t.Fatalf("backlog %d, stalled since %v; want 2 held and a stall", len(c.backlog), c.stalledSince)
+	}
+
+	c.stalledSince = time.Now().Add(-slowConsumerTimeout)
+	<-c.Send
+	c.flushBacklog()
+	if len(c.backlog) != 1 {
+		t.Fatalf("backlog %d after one write, want 1", len(c.backlog))
+	}
+	if time.Since(c.stalledSince) > time.Second {
+		t.Fatalf("stall still dates from %v after the writer made progress", c.stalledSince)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxChatHistory is how many chat messages each room keeps in memory
+	maxChatHistory = 500
+	// chatReplayCount is how many recent chat messages a joining client receives
+	chatReplayCount = 50
+	// maxChatPageSize caps the limit parameter of the messages endpoint
+	maxChatPageSize = 200
+	// maxChatLength is the longest chat message accepted, in characters
+	maxChatLength = 2000
+	// maxEmojiLength is the longest reaction accepted, in characters
+	maxEmojiLength = 16
+	// maxReactionsPerMessage caps distinct emoji reactions on one message
+	maxReactionsPerMessage = 20
+	// typingThrottle is the minimum interval between typing broadcasts per client
+	typingThrottle = 2 * time.Second
+)
+
+var errChatNotFound = errors.New("Message not found")
+
+// sanitizeText strips control characters other than newlines and trims spaces
+func sanitizeText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+	return strings.TrimSpace(text)
+}
+
+// validChatText sanitizes a chat message and checks its length
+func validChatText(text string) (string, error) {
+	text = sanitizeText(text)
+	if text == "" {
+		return "", errors.New("Message is empty")
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return "", fmt.Errorf("Message is longer than %d characters", maxChatLength)
+	}
+	return text, nil
+}
+
+// handleChatMessage processes chat, chat edits, deletes, reactions and typing indicators
+func (c *Client) handleChatMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypeChat:
+		var data ChatData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid chat message")
+			return
+		}
+
+		text, err := validChatText(data.Message)
+		if err != nil {
+			c.sendError(err.Error())
+			return
+		}
+		if data.ReplyTo != "" && !room.hasChat(data.ReplyTo) {
+			c.sendError("Reply target not found")
+			return
+		}
+
+		msg.Data = mustMarshal(ChatData{Message: text, ReplyTo: data.ReplyTo})
+		room.recordChat(&msg)
+		room.broadcast(mustMarshal(msg))
+		log.Printf("Room %s: %s: %s", room.ID, c.Username, text)
+
+	case MessageTypeChatEdit:
+		var data ChatEditData
+		json.Unmarshal(msg.Data, &data)
+
+		text, err := validChatText(data.Message)
+		if err != nil {
+			c.sendError(err.Error())
+			return
+		}
+
+		updated, err := room.updateChat(data.MessageID, func(original *Message, chat *ChatData) error {
+			if original.UserID != c.ID {
+				return errors.New("Only the author can edit this message")
+			}
+			if chat.Deleted {
+				return errChatNotFound
+			}
+			now := time.Now()
+			chat.Message = text
+			chat.EditedAt = &now
+			return nil
+		})
+		c.broadcastChatUpdate(msg.Type, updated, err)
+
+	case MessageTypeChatDelete:
+		var data ChatDeleteData
+		json.Unmarshal(msg.Data, &data)
+
+		updated, err := room.updateChat(data.MessageID, func(original *Message, chat *ChatData) error {
+			if original.UserID != c.ID && !c.isHost() {
+				return errors.New("Only the author or host can delete this message")
+			}
+			*chat = ChatData{Deleted: true}
+			return nil
+		})
+		c.broadcastChatUpdate(msg.Type, updated, err)
+
+	case MessageTypeChatReact:
+		var data ChatReactData
+		json.Unmarshal(msg.Data, &data)
+
+		emoji := sanitizeText(data.Emoji)
+		if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLength {
+			c.sendError("Invalid reaction")
+			return
+		}
+
+		updated, err := room.updateChat(data.MessageID, func(original *Message, chat *ChatData) error {
+			if chat.Deleted {
+				return errChatNotFound
+			}
+			users := chat.Reactions[emoji]
+			for i, id := range users {
+				if id == c.ID {
+					users = append(users[:i], users[i+1:]...)
+					break
+				}
+			}
+			if !data.Remove {
+				if chat.Reactions == nil {
+					chat.Reactions = make(map[string][]string)
+				}
+				if _, ok := chat.Reactions[emoji]; !ok && len(chat.Reactions) >= maxReactionsPerMessage {
+					return errors.New("Too many reactions on this message")
+				}
+				users = append(users, c.ID)
+			}
+			if len(users) == 0 {
+				delete(chat.Reactions, emoji)
+			} else {
+				chat.Reactions[emoji] = users
+			}
+			return nil
+		})
+		c.broadcastChatUpdate(msg.Type, updated, err)
+
+	case MessageTypeTyping:
+		var data TypingData
+		json.Unmarshal(msg.Data, &data)
+
+		// Typing starts are throttled; stops always go through so indicators clear promptly
+		if data.IsTyping && time.Since(c.LastTyping) < typingThrottle {
+			return
+		}
+		if data.IsTyping {
+			c.LastTyping = time.Now()
+		} else {
+			c.LastTyping = time.Time{}
+		}
+
+		msg.Data = mustMarshal(TypingData{IsTyping: data.IsTyping})
+		room.broadcast(mustMarshal(msg))
+	}
+}
+
+// broadcastChatUpdate sends an updated chat message to the room, or the error to the client
+func (c *Client) broadcastChatUpdate(msgType string, updated *Message, err error) {
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+
+	c.Room.broadcast(mustMarshal(Message{
+		ID:        updated.ID,
+		Type:      msgType,
+		RoomID:    c.Room.ID,
+		UserID:    c.ID,
+		Username:  c.Username,
+		Data:      updated.Data,
+		Timestamp: time.Now(),
+	}))
+	log.Printf("Room %s: %s %s message %s", c.Room.ID, c.Username, msgType, updated.ID)
+}
+
+// hasChat reports whether a message ID is in the room's in-memory history
+func (room *Room) hasChat(id string) bool {
+	room.chatMutex.Lock()
+	defer room.chatMutex.Unlock()
+
+	for _, msg := range room.Chat {
+		if msg.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// updateChat applies fn to a message in the in-memory history and persists
+// the new version. It returns a copy of the updated message.
+func (room *Room) updateChat(id string, fn func(original *Message, chat *ChatData) error) (*Message, error) {
+	room.chatMutex.Lock()
+	var updated *Message
+	var deleted bool
+	for i := range room.Chat {
+		if room.Chat[i].ID != id {
+			continue
+		}
+
+		var chat ChatData
+		json.Unmarshal(room.Chat[i].Data, &chat)
+		if err := fn(&room.Chat[i], &chat); err != nil {
+			room.chatMutex.Unlock()
+			return nil, err
+		}
+
+		room.Chat[i].Data = mustMarshal(chat)
+		copied := room.Chat[i]
+		updated = &copied
+		deleted = chat.Deleted
+		break
+	}
+	room.chatMutex.Unlock()
+
+	if updated == nil {
+		return nil, errChatNotFound
+	}
+
+	// A later line with the same ID replaces the earlier one. Deletes rewrite
+	// the log instead, so the original text does not stay on disk.
+	if store != nil {
+		roomID, saved := room.ID, *updated
+		queueStoreWrite("chat", roomID, func() {
+			var err error
+			if deleted {
+				err = redactChatLog(roomID, saved)
+			} else {
+				err = store.Append("chat", roomID, saved)
+			}
+			if err != nil {
+				log.Printf("Failed to persist chat update in room %s: %v", roomID, err)
+			}
+		})
+	}
+	return updated, nil
+}
+
+// redactChatLog rewrites a room's chat log with one line per message, the
+// deleted message replaced by its redacted version. It runs on the store writer.
+func redactChatLog(roomID string, deleted Message) error {
+	messages, err := readChatLog(roomID)
+	if err != nil {
+		return err
+	}
+
+	lines := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		if msg.ID == deleted.ID {
+			msg = deleted
+		}
+		lines[i] = msg
+	}
+	return store.RewriteLog("chat", roomID, lines)
+}
+
+// recordChat assigns the message an ID and appends it to the room's history
+func (room *Room) recordChat(msg *Message) {
+	msg.ID = uuid.New().String()[:8]
+
+	room.chatMutex.Lock()
+	room.Chat = append(room.Chat, *msg)
+	if len(room.Chat) > maxChatHistory {
+		room.Chat = room.Chat[len(room.Chat)-maxChatHistory:]
+	}
+	room.chatMutex.Unlock()
+
+	if store != nil {
+		roomID, saved := room.ID, *msg
+		queueStoreWrite("chat", roomID, func() {
+			if err := store.Append("chat", roomID, saved); err != nil {
+				log.Printf("Failed to persist chat message in room %s: %v", roomID, err)
+			}
+		})
+	}
+}
+
+// loadChat fills the in-memory history from the persistent store
+func (room *Room) loadChat() {
+	if store == nil {
+		return
+	}
+
+	messages, err := storedChat(room.ID)
+	if err != nil {
+		log.Printf("Failed to load chat history for room %s: %v", room.ID, err)
+		return
+	}
+	if len(messages) > maxChatHistory {
+		messages = messages[len(messages)-maxChatHistory:]
+	}
+
+	room.chatMutex.Lock()
+	room.Chat = messages
+	room.chatMutex.Unlock()
+}
+
+// storedChat reads a room's full chat log from the persistent store, once
+// the writes queued so far are done
+func storedChat(roomID string) ([]Message, error) {
+	flushStoreWrites()
+	return readChatLog(roomID)
+}
+
+// readChatLog reads a room's chat log, keeping the latest version of each message
+func readChatLog(roomID string) ([]Message, error) {
+	messages := make([]Message, 0)
+	index := make(map[string]int)
+	err := store.ReadLog("chat", roomID, func(line []byte) error {
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return err
+		}
+		// Edits, deletes and reactions are appended as new versions of the message
+		if i, ok := index[msg.ID]; ok {
+			messages[i] = msg
+			return nil
+		}
+		index[msg.ID] = len(messages)
+		messages = append(messages, msg)
+		return nil
+	})
+	return messages, err
+}
+
+// chatPage returns up to limit messages older than the message with ID before,
+// or the latest messages when before is empty
+func chatPage(messages []Message, before string, limit int) ([]Message, bool) {
+	end := len(messages)
+	if before != "" {
+		end = -1
+		for i, msg := range messages {
+			if msg.ID == before {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, false
+		}
+	}
+
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+
+	page := make([]Message, end-start)
+	copy(page, messages[start:end])
+	return page, start > 0
+}
+
+// recentChat returns a page of the room's history, falling back to the
+// persistent store once the in-memory history has been trimmed
+func (room *Room) recentChat(before string, limit int) ([]Message, bool) {
+	room.chatMutex.Lock()
+	page, hasMore := chatPage(room.Chat, before, limit)
+	trimmed := len(room.Chat) >= maxChatHistory
+	room.chatMutex.Unlock()
+
+	// The in-memory page is complete unless it ran into the trimmed start of the history
+	if store == nil || !trimmed || (page != nil && hasMore) {
+		return page, hasMore
+	}
+
+	messages, err := storedChat(room.ID)
+	if err != nil {
+		log.Printf("Failed to read chat history for room %s: %v", room.ID, err)
+		return page, hasMore
+	}
+	return chatPage(messages, before, limit)
+}
+
+// sendChatHistory sends the most recent chat messages to a joining client
+func (room *Room) sendChatHistory(client *Client) {
+	messages, hasMore := room.recentChat("", chatReplayCount)
+
+	msg := Message{
+		Type:   MessageTypeChatHistory,
+		RoomID: room.ID,
+		Data: mustMarshal(ChatHistoryData{
+			Messages: messages,
+			HasMore:  hasMore,
+		}),
+		Timestamp: time.Now(),
+	}
+
+	client.send(mustMarshal(msg))
+}
+
+// GetRoomMessages returns a page of a room's chat history
+func GetRoomMessages(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	limit := chatReplayCount
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if parsed > maxChatPageSize {
+			parsed = maxChatPageSize
+		}
+		limit = parsed
+	}
+
+	messages, hasMore := room.recentChat(r.URL.Query().Get("before"), limit)
+	if messages == nil {
+		messages = make([]Message, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ChatHistoryData{
+		Messages: messages,
+		HasMore:  hasMore,
+	})
+}
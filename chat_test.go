@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// useTestStore persists to a temporary directory until the test ends
+func useTestStore(t *testing.T) {
+	t.Helper()
+
+	fs, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	StartStoreWriter()
+	store = fs
+	t.Cleanup(func() {
+		flushStoreWrites()
+		store = nil
+	})
+}
+
+// TestChatPersistsToStore checks chat messages reach the store's chat log
+func TestChatPersistsToStore(t *testing.T) {
+	useTestStore(t)
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	conn, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, MessageTypeSync)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"hello"}}`))
+	sent := readUntil(t, conn, MessageTypeChat)
+
+	messages, err := storedChat(room.ID)
+	if err != nil {
+		t.Fatalf("read chat log: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != sent.ID {
+		t.Fatalf("chat log holds %+v, want message %s", messages, sent.ID)
+	}
+	var chat ChatData
+	json.Unmarshal(messages[0].Data, &chat)
+	if chat.Message != "hello" {
+		t.Fatalf("stored chat %q, want hello", chat.Message)
+	}
+}
+
+// TestDeletedChatIsRedactedInStore checks a deleted message's text does not
+// stay in the stored chat log
+func TestDeletedChatIsRedactedInStore(t *testing.T) {
+	useTestStore(t)
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	conn, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, MessageTypeSync)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"my secret"}}`))
+	sent := readUntil(t, conn, MessageTypeChat)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"still here"}}`))
+	readUntil(t, conn, MessageTypeChat)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chatDelete","data":{"messageId":"`+sent.ID+`"}}`))
+	readUntil(t, conn, MessageTypeChatDelete)
+
+	flushStoreWrites()
+	lines := 0
+	store.ReadLog("chat", room.ID, func(line []byte) error {
+		lines++
+		if bytes.Contains(line, []byte("my secret")) {
+			t.Errorf("chat log still holds the deleted text: %s", line)
+		}
+		return nil
+	})
+	if lines != 2 {
+		t.Fatalf("chat log has %d lines, want 2", lines)
+	}
+
+	messages, _ := storedChat(room.ID)
+	var chat ChatData
+	json.Unmarshal(messages[0].Data, &chat)
+	if messages[0].ID != sent.ID || !chat.Deleted {
+		t.Fatalf("first stored message is %+v, want %s deleted", messages[0], sent.ID)
+	}
+}
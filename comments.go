@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxCommentLength is the longest timestamped comment accepted, in characters
+	maxCommentLength = 500
+	// commentLookahead is how far ahead of the playback position comments are pushed, in seconds
+	commentLookahead = 5.0
+	// maxCommentsPerPage caps how many comments the list endpoint returns
+	maxCommentsPerPage = 500
+)
+
+// commentRecord is a comment together with the token that allows deleting it
+type commentRecord struct {
+	*Comment
+	DeleteToken string `json:"deleteToken"`
+}
+
+var (
+	comments      = make(map[string][]*commentRecord) // MovieID -> comments sorted by offset
+	commentsMutex sync.Mutex
+)
+
+// movieComments returns a movie's comments, loading them from the store on
+// first use. The caller must hold commentsMutex.
+func movieComments(movieID string) []*commentRecord {
+	records, ok := comments[movieID]
+	if ok {
+		return records
+	}
+
+	records = make([]*commentRecord, 0)
+	if store != nil {
+		if err := store.Get("comments", movieID, &records); err != nil && err != errNotFound {
+			log.Printf("Failed to load comments for movie %s: %v", movieID, err)
+		}
+	}
+	comments[movieID] = records
+	return records
+}
+
+// saveComments queues a copy of a movie's comments to be persisted. The caller
+// must hold commentsMutex, which keeps the writes in order.
+func saveComments(movieID string) {
+	if store == nil {
+		return
+	}
+	records := append([]*commentRecord(nil), comments[movieID]...)
+	queueStoreWrite("comments", movieID, func() {
+		if err := store.Put("comments", movieID, records); err != nil {
+			log.Printf("Failed to persist comments for movie %s: %v", movieID, err)
+		}
+	})
+}
+
+// commentsBetween returns the comments with from <= offset < to, ordered by offset
+func commentsBetween(movieID string, from, to float64) []Comment {
+	commentsMutex.Lock()
+	defer commentsMutex.Unlock()
+
+	records := movieComments(movieID)
+	start := sort.Search(len(records), func(i int) bool {
+		return records[i].Offset >= from
+	})
+
+	result := make([]Comment, 0)
+	for _, record := range records[start:] {
+		if record.Offset >= to || len(result) >= maxCommentsPerPage {
+			break
+		}
+		result = append(result, *record.Comment)
+	}
+	return result
+}
+
+// position estimates the room's current playback position in seconds
+func (room *Room) position() float64 {
+	pos := room.VideoState.CurrentTime
+	if room.VideoState.IsPlaying {
+		pos += time.Since(room.VideoState.UpdatedAt).Seconds()
+	}
+	return pos
+}
+
+// pushComments sends the comments coming up next in the current movie to the room
+func (room *Room) pushComments() {
+	if room.MovieID == "" || room.CustomVideoURL != "" || len(room.Clients) == 0 || !room.VideoState.IsPlaying {
+		return
+	}
+
+	// Restart from the current position after a movie change or a seek
+	pos := room.position()
+	if room.commentMovie != room.MovieID || room.commentCursor > pos+commentLookahead || pos-room.commentCursor > 2*commentLookahead {
+		room.commentMovie = room.MovieID
+		room.commentCursor = pos
+	}
+
+	end := pos + commentLookahead
+	upcoming := commentsBetween(room.MovieID, room.commentCursor, end)
+	room.commentCursor = end
+	if len(upcoming) == 0 {
+		return
+	}
+
+	msg := Message{
+		Type:      MessageTypeComments,
+		RoomID:    room.ID,
+		Data:      mustMarshal(upcoming),
+		Timestamp: time.Now(),
+	}
+	room.broadcast(mustMarshal(msg))
+}
+
+// CreateComment pins a comment to a position in a movie
+func CreateComment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	movieID := params["id"]
+
+	var movie *Movie
+	for i := range movies {
+		if movies[i].ID == movieID {
+			movie = &movies[i]
+			break
+		}
+	}
+	if movie == nil {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	}
+
+	var req CreateCommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Offset < 0 || math.IsNaN(req.Offset) || math.IsInf(req.Offset, 0) ||
+		(movie.Duration > 0 && req.Offset > float64(movie.Duration)) {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	text := sanitizeText(req.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxCommentLength {
+		http.Error(w, "Comment must be 1-500 characters", http.StatusBadRequest)
+		return
+	}
+
+	username := sanitizeText(req.Username)
+	if username == "" {
+		username = "Anonymous"
+	}
+
+	record := &commentRecord{
+		Comment: &Comment{
+			ID:        uuid.New().String()[:8],
+			MovieID:   movieID,
+			Offset:    req.Offset,
+			Username:  username,
+			Text:      text,
+			CreatedAt: time.Now(),
+		},
+		DeleteToken: uuid.New().String(),
+	}
+
+	commentsMutex.Lock()
+	records := movieComments(movieID)
+	i := sort.Search(len(records), func(i int) bool {
+		return records[i].Offset > record.Offset
+	})
+	records = append(records, nil)
+	copy(records[i+1:], records[i:])
+	records[i] = record
+	comments[movieID] = records
+	saveComments(movieID)
+	commentsMutex.Unlock()
+
+	log.Printf("Comment %s added to movie %s at %.2f by %s", record.ID, movieID, record.Offset, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateCommentResponse{
+		Comment:     record.Comment,
+		DeleteToken: record.DeleteToken,
+	})
+}
+
+// GetComments lists a movie's comments, optionally within ?from=&to= seconds
+func GetComments(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	movieID := params["id"]
+
+	if !findMovie(movieID) {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	}
+
+	from, to := 0.0, math.Inf(1)
+	for name, target := range map[string]*float64{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(parsed) {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+		*target = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commentsBetween(movieID, from, to))
+}
+
+// DeleteComment removes a comment given the delete token issued when it was created
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	movieID := params["id"]
+	commentID := params["commentId"]
+	token := r.Header.Get("X-Delete-Token")
+
+	if !findMovie(movieID) {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	}
+
+	commentsMutex.Lock()
+	defer commentsMutex.Unlock()
+
+	records := movieComments(movieID)
+	for i, record := range records {
+		if record.ID != commentID {
+			continue
+		}
+		if token == "" || token != record.DeleteToken {
+			http.Error(w, "Invalid delete token", http.StatusForbidden)
+			return
+		}
+
+		comments[movieID] = append(records[:i], records[i+1:]...)
+		saveComments(movieID)
+		log.Printf("Comment %s deleted from movie %s", commentID, movieID)
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(w, "Comment not found", http.StatusNotFound)
+}
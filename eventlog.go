@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Event log entry kinds
+const (
+	EventState     = "state"     // Room state when Run started
+	EventBroadcast = "broadcast" // A message delivered to the whole room
+	EventJoin      = "join"
+	EventLeave     = "leave"
+)
+
+// maxEventLog is how many event log entries each room keeps in memory
+const maxEventLog = 10000
+
+// recordEvent appends an entry to the room's event log. Replay rooms do not
+// record their own playback.
+func (room *Room) recordEvent(kind string, client *Client, message []byte) {
+	if room.ReplayOf != "" {
+		return
+	}
+
+	event := RoomEvent{
+		Time:    time.Now(),
+		Kind:    kind,
+		Message: message,
+	}
+	if client != nil {
+		event.UserID = client.ID
+		event.Username = client.Username
+	}
+
+	room.eventsMutex.Lock()
+	room.Events = append(room.Events, event)
+	if len(room.Events) > maxEventLog {
+		room.Events = room.Events[len(room.Events)-maxEventLog:]
+	}
+	room.eventsMutex.Unlock()
+
+	if store != nil {
+		roomID := room.ID
+		queueStoreWrite("events", roomID, func() {
+			if err := store.Append("events", roomID, event); err != nil {
+				log.Printf("Failed to persist event in room %s: %v", roomID, err)
+			}
+		})
+	}
+}
+
+// roomEvents returns a room's full event log, oldest first, with deleted
+// chat messages redacted. The store's log outlives a restart, so it is
+// preferred to the in-memory one.
+func roomEvents(room *Room) ([]RoomEvent, error) {
+	if store != nil {
+		flushStoreWrites()
+		events := make([]RoomEvent, 0)
+		err := store.ReadLog("events", room.ID, func(line []byte) error {
+			var event RoomEvent
+			if err := json.Unmarshal(line, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+			return nil
+		})
+		return redactDeletedChat(events), err
+	}
+
+	room.eventsMutex.Lock()
+	events := append(make([]RoomEvent, 0, len(room.Events)), room.Events...)
+	room.eventsMutex.Unlock()
+	return redactDeletedChat(events), nil
+}
+
+// redactDeletedChat replaces chat messages that were later deleted, and their
+// edits and reactions, with tombstones, so exports and replays do not bring
+// deleted text back
+func redactDeletedChat(events []RoomEvent) []RoomEvent {
+	deleted := make(map[string]bool)
+	for _, event := range events {
+		if event.Kind != EventBroadcast || messageType(event.Message) != MessageTypeChatDelete {
+			continue
+		}
+		var msg Message
+		if json.Unmarshal(event.Message, &msg) == nil {
+			deleted[msg.ID] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return events
+	}
+
+	for i, event := range events {
+		if event.Kind != EventBroadcast {
+			continue
+		}
+		var msg Message
+		if json.Unmarshal(event.Message, &msg) != nil || !deleted[msg.ID] {
+			continue
+		}
+		switch msg.Type {
+		case MessageTypeChat, MessageTypeChatEdit, MessageTypeChatReact:
+			msg.Data = mustMarshal(ChatData{Deleted: true})
+			events[i].Message = mustMarshal(msg)
+		}
+	}
+	return events
+}
+
+// GetRoomEvents exports a room's event log as JSON Lines. Only the host may
+// export it, with the host token in the X-Host-Token header.
+func GetRoomEvents(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if !room.isHostToken(r.Header.Get("X-Host-Token")) {
+		http.Error(w, "Only the host can export the event log", http.StatusForbidden)
+		return
+	}
+
+	events, err := roomEvents(room)
+	if err != nil {
+		log.Printf("Failed to read events for room %s: %v", roomID, err)
+		http.Error(w, "Failed to read event log", http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "No recorded events", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"room-"+roomID+"-events.jsonl\"")
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		encoder.Encode(event)
+	}
+}
+
+// ReplayRoom creates a room that plays a recorded session back in real time.
+// Everyone in a replay room is a spectator, and the room lives on this node
+// only. Only the source room's host may replay it, as with GetRoomEvents.
+func ReplayRoom(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	sourceID := params["id"]
+
+	source, exists := lookupRoom(sourceID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if !source.isHostToken(r.Header.Get("X-Host-Token")) {
+		http.Error(w, "Only the host can replay the room", http.StatusForbidden)
+		return
+	}
+
+	var req ReplayRoomRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	events, err := roomEvents(source)
+	if err != nil {
+		log.Printf("Failed to read events for room %s: %v", sourceID, err)
+		http.Error(w, "Failed to read event log", http.StatusInternalServerError)
+		return
+	}
+
+	// Playback starts from the first recorded room state
+	start := -1
+	for i, event := range events {
+		if event.Kind == EventState {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		http.Error(w, "No recorded session", http.StatusNotFound)
+		return
+	}
+	events = events[start:]
+
+	var initial Message
+	var state SyncData
+	json.Unmarshal(events[0].Message, &initial)
+	json.Unmarshal(initial.Data, &state)
+
+	room := newRoom(uuid.New().String()[:8])
+	room.ReplayOf = sourceID
+	room.HostID = uuid.New().String()[:8]
+	room.HostToken = uuid.New().String()
+	room.Name = req.RoomName
+	if room.Name == "" {
+		room.Name = "Replay of " + sourceID
+	}
+	room.Settings = normalizeRoomSettings(&RoomSettings{DefaultRole: RoleSpectator})
+	room.setNowPlaying(state.NowPlaying)
+	if state.Queue != nil {
+		room.Queue = state.Queue
+	}
+	if state.VideoState != nil {
+		room.VideoState = state.VideoState
+		room.VideoState.UpdatedAt = time.Now()
+	}
+
+	room.Start()
+	go room.replay(events[1:], events[0].Time)
+
+	roomsMutex.Lock()
+	rooms[room.ID] = room
+	roomsMutex.Unlock()
+
+	log.Printf("Room %s: replaying %d events of room %s", room.ID, len(events)-1, sourceID)
+
+	resp := CreateRoomResponse{
+		Room:      room.Snapshot().Info,
+		UserID:    room.HostID,
+		HostToken: room.HostToken,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// How a recorded broadcast is played back; types not listed are skipped, so
+// the original room's users, call and share do not appear in the replay
+const (
+	replaySkip  = iota
+	replayApply // Updates the replay room's playback or queue
+	replayShow  // Shown to viewers without changing the room
+)
+
+var replayedMessages = map[string]int{
+	MessageTypePlay:       replayApply,
+	MessageTypePause:      replayApply,
+	MessageTypeSeek:       replayApply,
+	MessageTypeSync:       replayApply,
+	MessageTypeQueue:      replayApply,
+	MessageTypeChat:       replayShow,
+	MessageTypeChatEdit:   replayShow,
+	MessageTypeChatDelete: replayShow,
+	MessageTypeChatReact:  replayShow,
+	MessageTypeReactions:  replayShow,
+}
+
+// replay applies recorded broadcasts to the room at their original pace,
+// measured from origin, and announces the end of the recording
+func (room *Room) replay(events []RoomEvent, origin time.Time) {
+	started := time.Now()
+
+	for _, event := range events {
+		if event.Kind != EventBroadcast && event.Kind != EventState {
+			continue
+		}
+
+		wait := event.Time.Sub(origin) - time.Since(started)
+		select {
+		case <-time.After(wait):
+		case <-room.done:
+			return
+		}
+
+		// State entries are sync messages, so a source restart resyncs everyone
+		data := []byte(event.Message)
+		switch replayedMessages[messageType(data)] {
+		case replayApply:
+			room.do(func() { room.applyRemote(data) })
+		case replayShow:
+			room.do(func() { room.deliver(data) })
+		}
+	}
+
+	room.do(func() {
+		room.deliver(mustMarshal(Message{
+			Type:      MessageTypeReplayEnded,
+			RoomID:    room.ID,
+			Timestamp: time.Now(),
+		}))
+		log.Printf("Room %s: replay of %s finished", room.ID, room.ReplayOf)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestEventExportNeedsHostAndRedactsDeletedChat checks the export is refused
+// without the host token and does not contain deleted chat text
+func TestEventExportNeedsHostAndRedactsDeletedChat(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	conn, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"secret words"}}`))
+	chat := readUntil(t, conn, MessageTypeChat)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chatDelete","data":{"messageId":"`+chat.ID+`"}}`))
+	readUntil(t, conn, MessageTypeChatDelete)
+
+	export := func(token string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+"/api/rooms/"+room.ID+"/events", nil)
+		if token != "" {
+			req.Header.Set("X-Host-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := export(""); status != http.StatusForbidden {
+		t.Fatalf("export without host token: status %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := export("wrong"); status != http.StatusForbidden {
+		t.Fatalf("export with wrong host token: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	status, body := export(room.HostToken)
+	if status != http.StatusOK {
+		t.Fatalf("export: status %d", status)
+	}
+	if strings.Contains(body, "secret words") {
+		t.Fatalf("export contains deleted chat text:\n%s", body)
+	}
+	if !strings.Contains(body, chat.ID) {
+		t.Fatalf("export lost the deleted message's tombstone:\n%s", body)
+	}
+}
+
+// TestReplayOnlyAppliesPlaybackAndChat checks a replay room plays back the
+// recording's playback and chat but not its users or call
+func TestReplayOnlyAppliesPlaybackAndChat(t *testing.T) {
+	server := newTestServer(t)
+	source := createTestRoom(t, server)
+
+	alice, err := dialRoom(t, server, source.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer alice.Close()
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"mediaJoin","data":{"audio":false,"video":false}}`))
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"play","data":{"currentTime":12}}`))
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"recorded"}}`))
+	readUntil(t, alice, MessageTypeChat)
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/rooms/"+source.ID+"/replay", nil)
+	req.Header.Set("X-Host-Token", source.HostToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	var created CreateRoomResponse
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	replay, ok := lookupRoom(created.Room.ID)
+	if !ok {
+		t.Fatalf("replay room %s not registered", created.Room.ID)
+	}
+	t.Cleanup(func() {
+		replay.Close("test finished")
+		forgetRoom(replay)
+	})
+
+	viewer, err := dialRoom(t, server, replay.ID, "viewer")
+	if err != nil {
+		t.Fatalf("dial replay: %v", err)
+	}
+	defer viewer.Close()
+
+	seen := make(map[string]bool)
+	viewer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !seen[MessageTypeReplayEnded] {
+		_, data, err := viewer.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for replayEnded: %v", err)
+		}
+		var msg Message
+		json.Unmarshal(data, &msg)
+		seen[msg.Type] = true
+		if msg.Type == MessageTypeUserList && strings.Contains(string(msg.Data), "alice") {
+			t.Fatalf("replay showed the recorded user list: %s", msg.Data)
+		}
+		if msg.Type == MessageTypeMediaJoin {
+			t.Fatal("replay forwarded a recorded mediaJoin")
+		}
+	}
+	if !seen[MessageTypePlay] || !seen[MessageTypeChat] {
+		t.Fatalf("replay is missing play or chat, saw %v", seen)
+	}
+
+	media := make(chan int)
+	replay.do(func() { media <- len(replay.Media) })
+	if n := <-media; n != 0 {
+		t.Fatalf("replay room has %d call peers, want 0", n)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPlaylistBytes is the largest playlist the proxy will rewrite
+	maxPlaylistBytes = 4 << 20
+	// maxCachedSegmentBytes is the largest segment kept in the cache
+	maxCachedSegmentBytes = 16 << 20
+	defaultHLSCacheMB     = 64
+	// segmentFetchTimeout bounds a shared segment download, which outlives
+	// the request that started it
+	segmentFetchTimeout = 30 * time.Second
+)
+
+// playlistURIPattern matches URI attributes of tags such as EXT-X-KEY and EXT-X-MAP
+var playlistURIPattern = regexp.MustCompile(`URI="([^"]*)"`)
+
+// hlsProxy fetches HLS playlists and segments from allowlisted hosts on behalf
+// of browsers that cannot load them directly because of CORS or mixed content.
+// Playlists are rewritten so every URI they reference goes through the proxy.
+type hlsProxy struct {
+	client   *http.Client
+	allowed  []string // Hostnames; "*.example.com" also matches subdomains
+	basePath string   // Route rewritten URIs point back to
+	cache    *segmentCache
+}
+
+// newHLSProxy creates a proxy for the allowed hosts, served at basePath
+func newHLSProxy(allowed []string, basePath string, cacheBytes int64) *hlsProxy {
+	p := &hlsProxy{
+		allowed:  allowed,
+		basePath: basePath,
+		cache:    newSegmentCache(cacheBytes),
+	}
+	p.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 15 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			if !p.allowedURL(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+			}
+			return nil
+		},
+	}
+	return p
+}
+
+// NewHLSProxyFromEnv creates the proxy served at /api/hls. HLS_PROXY_HOSTS is a
+// comma-separated host allowlist (the proxy refuses everything when it is
+// empty) and HLS_CACHE_MB sizes the segment cache.
+func NewHLSProxyFromEnv() *hlsProxy {
+	var allowed []string
+	for _, host := range strings.Split(os.Getenv("HLS_PROXY_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			allowed = append(allowed, host)
+		}
+	}
+
+	cacheMB := defaultHLSCacheMB
+	if v, err := strconv.Atoi(os.Getenv("HLS_CACHE_MB")); err == nil && v >= 0 {
+		cacheMB = v
+	}
+
+	if len(allowed) > 0 {
+		log.Printf("HLS proxy enabled for %s", strings.Join(allowed, ", "))
+	}
+	return newHLSProxy(allowed, "/api/hls", int64(cacheMB)<<20)
+}
+
+// allowedURL reports whether the proxy may fetch u
+func (p *hlsProxy) allowedURL(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range p.allowed {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyURL returns the proxy route for an upstream URL
+func (p *hlsProxy) proxyURL(u *url.URL) string {
+	return p.basePath + "?url=" + url.QueryEscape(u.String())
+}
+
+// ServeHTTP proxies the upstream URL given in the url query parameter
+func (p *hlsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upstream, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || !upstream.IsAbs() {
+		http.Error(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+	if !p.allowedURL(upstream) {
+		http.Error(w, "Host not allowed", http.StatusForbidden)
+		return
+	}
+
+	key := upstream.String()
+
+	// Playlists change while live, so they are always fetched
+	if isPlaylistPath(upstream) {
+		p.passThrough(w, r, upstream)
+		return
+	}
+
+	if segment := p.cache.get(key); segment != nil {
+		serveSegment(w, r, segment)
+		return
+	}
+
+	// Range requests that miss the cache go straight to the origin
+	if r.Header.Get("Range") != "" {
+		p.passThrough(w, r, upstream)
+		return
+	}
+
+	segment, fetch, leader := p.cache.claim(key)
+	switch {
+	case segment != nil:
+		serveSegment(w, r, segment)
+	case leader:
+		p.fetchSegment(w, r, upstream)
+	default:
+		// Another viewer is already downloading this segment
+		select {
+		case <-fetch.done:
+		case <-r.Context().Done():
+			return
+		}
+		if fetch.segment != nil {
+			serveSegment(w, r, fetch.segment)
+		} else {
+			p.passThrough(w, r, upstream)
+		}
+	}
+}
+
+// fetch requests an upstream URL, forwarding the client's Range header
+func (p *hlsProxy) fetch(ctx context.Context, upstream *url.URL, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	return p.client.Do(req)
+}
+
+// passThrough proxies a request without caching, rewriting playlists
+func (p *hlsProxy) passThrough(w http.ResponseWriter, r *http.Request, upstream *url.URL) {
+	resp, err := p.fetch(r.Context(), upstream, r.Header.Get("Range"))
+	if err != nil {
+		log.Printf("HLS proxy: %s: %v", upstream, err)
+		http.Error(w, "Upstream request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	p.respond(w, resp, nil)
+}
+
+// fetchSegment downloads a segment for every viewer waiting on it, caching it
+// when it fits, and serves it to this client. The download is not cancelled
+// when this client goes away, since the others still need it.
+func (p *hlsProxy) fetchSegment(w http.ResponseWriter, r *http.Request, upstream *url.URL) {
+	key := upstream.String()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), segmentFetchTimeout)
+	defer cancel()
+
+	resp, err := p.fetch(ctx, upstream, "")
+	if err != nil {
+		p.cache.finish(key, nil)
+		log.Printf("HLS proxy: %s: %v", upstream, err)
+		http.Error(w, "Upstream request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || isPlaylistResponse(resp) || resp.ContentLength > maxCachedSegmentBytes {
+		p.cache.finish(key, nil)
+		p.respond(w, resp, nil)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedSegmentBytes+1))
+	if err != nil {
+		p.cache.finish(key, nil)
+		http.Error(w, "Upstream request failed", http.StatusBadGateway)
+		return
+	}
+	if len(data) > maxCachedSegmentBytes {
+		// Too big to cache after all; send what was read followed by the rest
+		p.cache.finish(key, nil)
+		p.respond(w, resp, data)
+		return
+	}
+
+	segment := &cachedSegment{
+		key:         key,
+		data:        data,
+		contentType: resp.Header.Get("Content-Type"),
+	}
+	p.cache.finish(key, segment)
+	serveSegment(w, r, segment)
+}
+
+// respond copies an upstream response to the client. Playlists are rewritten;
+// anything else is streamed, starting with prefix if part of the body was
+// already read.
+func (p *hlsProxy) respond(w http.ResponseWriter, resp *http.Response, prefix []byte) {
+	if resp.StatusCode >= 400 {
+		http.Error(w, "Upstream returned "+resp.Status, resp.StatusCode)
+		return
+	}
+
+	if isPlaylistResponse(resp) || (prefix == nil && isPlaylistPath(resp.Request.URL)) {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistBytes+1))
+		if err != nil || len(body) > maxPlaylistBytes {
+			http.Error(w, "Invalid playlist", http.StatusBadGateway)
+			return
+		}
+
+		// Relative URIs resolve against the final URL after redirects
+		rewritten := p.rewritePlaylist(body, resp.Request.URL)
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Length", strconv.Itoa(len(rewritten)))
+		w.Write(rewritten)
+		return
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag", "Cache-Control"} {
+		if v := resp.Header.Get(header); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(prefix)
+	io.Copy(w, resp.Body)
+}
+
+// rewritePlaylist points every URI in a playlist at the proxy
+func (p *hlsProxy) rewritePlaylist(body []byte, base *url.URL) []byte {
+	rewrite := func(uri string) string {
+		ref, err := url.Parse(strings.TrimSpace(uri))
+		if err != nil {
+			return uri
+		}
+		return p.proxyURL(base.ResolveReference(ref))
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), maxPlaylistBytes)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, "#"):
+			// Tags such as EXT-X-KEY, EXT-X-MAP and EXT-X-MEDIA carry URI attributes
+			line = playlistURIPattern.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := playlistURIPattern.FindStringSubmatch(attr)[1]
+				return `URI="` + rewrite(uri) + `"`
+			})
+		case strings.TrimSpace(line) != "":
+			line = rewrite(line)
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+func isPlaylistPath(u *url.URL) bool {
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".m3u8" || ext == ".m3u"
+}
+
+func isPlaylistResponse(resp *http.Response) bool {
+	return strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "mpegurl")
+}
+
+// serveSegment serves a cached segment, honouring Range requests
+func serveSegment(w http.ResponseWriter, r *http.Request, segment *cachedSegment) {
+	if segment.contentType != "" {
+		w.Header().Set("Content-Type", segment.contentType)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(segment.data))
+}
+
+// cachedSegment is a fully downloaded segment
+type cachedSegment struct {
+	key         string
+	data        []byte
+	contentType string
+}
+
+// segmentFetch is a download other viewers of the same segment wait on
+type segmentFetch struct {
+	done    chan struct{}
+	segment *cachedSegment // Set before done is closed; nil if it was not cached
+}
+
+// segmentCache is an LRU cache of recent segments bounded by total size. It
+// also deduplicates concurrent downloads of the same segment.
+type segmentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // Most recently used first
+	items    map[string]*list.Element
+	inflight map[string]*segmentFetch
+}
+
+func newSegmentCache(maxBytes int64) *segmentCache {
+	return &segmentCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		inflight: make(map[string]*segmentFetch),
+	}
+}
+
+// get returns a cached segment, or nil
+func (c *segmentCache) get(key string) *cachedSegment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedSegment)
+}
+
+// claim returns the cached segment if there is one. Otherwise it returns the
+// download in progress, and leader is true when the caller must perform it
+// and call finish.
+func (c *segmentCache) claim(key string) (segment *cachedSegment, fetch *segmentFetch, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cachedSegment), nil, false
+	}
+	if fetch, ok := c.inflight[key]; ok {
+		return nil, fetch, false
+	}
+
+	fetch = &segmentFetch{done: make(chan struct{})}
+	c.inflight[key] = fetch
+	return nil, fetch, true
+}
+
+// finish completes a download, caching segment if it is not nil, and wakes
+// the viewers waiting on it
+func (c *segmentCache) finish(key string, segment *cachedSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fetch := c.inflight[key]
+	delete(c.inflight, key)
+
+	if segment != nil && int64(len(segment.data)) <= c.maxBytes {
+		c.items[key] = c.order.PushFront(segment)
+		c.size += int64(len(segment.data))
+		for c.size > c.maxBytes {
+			oldest := c.order.Back()
+			evicted := oldest.Value.(*cachedSegment)
+			c.order.Remove(oldest)
+			delete(c.items, evicted.key)
+			c.size -= int64(len(evicted.data))
+		}
+	}
+
+	if fetch != nil {
+		fetch.segment = segment
+		close(fetch.done)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHLSProxy serves an HLS proxy allowed to fetch from upstream
+func newTestHLSProxy(t *testing.T, upstream *httptest.Server) *httptest.Server {
+	t.Helper()
+
+	u, _ := url.Parse(upstream.URL)
+	proxy := httptest.NewServer(newHLSProxy([]string{u.Hostname()}, "/api/hls", 1<<20))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func proxiedURL(proxy *httptest.Server, upstream string) string {
+	return proxy.URL + "/api/hls?url=" + url.QueryEscape(upstream)
+}
+
+// TestHLSProxySharesSegmentFetch checks concurrent viewers of a segment cause
+// one upstream request, even when the viewer that started it goes away
+func TestHLSProxySharesSegmentFetch(t *testing.T) {
+	var hits atomic.Int32
+	started := make(chan struct{})
+	abandoned := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := hits.Add(1) == 1
+		if first {
+			close(started)
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			if first {
+				close(abandoned)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write([]byte("segment data"))
+	}))
+	defer upstream.Close()
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+	proxy := newTestHLSProxy(t, upstream)
+	segmentURL := proxiedURL(proxy, upstream.URL+"/seg1.ts")
+
+	// The first viewer starts the download and then leaves
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		req, _ := http.NewRequestWithContext(ctx, "GET", segmentURL, nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	const viewers = 10
+	var wg sync.WaitGroup
+	bodies := make([]string, viewers)
+	for i := 0; i < viewers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(segmentURL)
+			if err != nil {
+				t.Errorf("viewer %d: %v", i, err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(body)
+		}(i)
+	}
+
+	// Give the proxy time to notice the first viewer left; the download
+	// must carry on for the others
+	cancel()
+	<-firstDone
+	select {
+	case <-abandoned:
+		t.Fatal("upstream download was cancelled with the first viewer")
+	case <-time.After(200 * time.Millisecond):
+	}
+	releaseOnce.Do(func() { close(release) })
+	wg.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream was hit %d times, want 1", n)
+	}
+	for i, body := range bodies {
+		if body != "segment data" {
+			t.Fatalf("viewer %d got %q", i, body)
+		}
+	}
+}
+
+// TestHLSProxyRewritesPlaylist checks every URI in a playlist points back at
+// the proxy, resolved against the playlist's URL
+func TestHLSProxyRewritesPlaylist(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		io.WriteString(w, "#EXTM3U\n"+
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n"+
+			"#EXT-X-MAP:URI=\"/init.mp4\"\n"+
+			"#EXTINF:4.0,\n"+
+			"seg1.ts\n"+
+			"#EXTINF:4.0,\n"+
+			"https://cdn.example.com/seg2.ts\n")
+	}))
+	defer upstream.Close()
+	proxy := newTestHLSProxy(t, upstream)
+
+	resp, err := http.Get(proxiedURL(proxy, upstream.URL+"/live/index.m3u8"))
+	if err != nil {
+		t.Fatalf("get playlist: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	playlist := string(body)
+
+	for _, want := range []string{
+		`URI="/api/hls?url=` + url.QueryEscape(upstream.URL+"/live/key.bin") + `"`,
+		`URI="/api/hls?url=` + url.QueryEscape(upstream.URL+"/init.mp4") + `"`,
+		"\n/api/hls?url=" + url.QueryEscape(upstream.URL+"/live/seg1.ts") + "\n",
+		"\n/api/hls?url=" + url.QueryEscape("https://cdn.example.com/seg2.ts") + "\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist is missing %s:\n%s", want, playlist)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultTURNCredentialTTL = 6 * time.Hour
+
+var (
+	// ICE server configuration, read by ConfigureICE
+	stunServers       []string
+	turnServers       []string
+	turnSecret        string
+	turnCredentialTTL = defaultTURNCredentialTTL
+)
+
+// ConfigureICE reads the ICE servers handed to WebRTC clients. STUN_SERVERS
+// and TURN_SERVERS are comma-separated URLs; TURN_SECRET is the shared secret
+// of the TURN server's REST API (coturn's static-auth-secret) and
+// TURN_CREDENTIAL_TTL how long issued credentials stay valid.
+func ConfigureICE() error {
+	var err error
+	if stunServers, err = iceURLsEnv("STUN_SERVERS", "stun:", "stuns:"); err != nil {
+		return err
+	}
+	if turnServers, err = iceURLsEnv("TURN_SERVERS", "turn:", "turns:"); err != nil {
+		return err
+	}
+
+	turnSecret = os.Getenv("TURN_SECRET")
+	if len(turnServers) > 0 && turnSecret == "" {
+		return fmt.Errorf("TURN_SERVERS needs TURN_SECRET")
+	}
+	return durationEnv("TURN_CREDENTIAL_TTL", &turnCredentialTTL)
+}
+
+func iceURLsEnv(name string, schemes ...string) ([]string, error) {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv(name), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		valid := false
+		for _, scheme := range schemes {
+			valid = valid || strings.HasPrefix(u, scheme)
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid %s entry %q", name, u)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// turnCredentials returns a time-limited TURN username and password for a
+// user following the TURN REST API: the username is "expiry:userID" and the
+// password the base64 HMAC-SHA1 of it under the shared secret
+func turnCredentials(userID string, expiresAt time.Time) (string, string) {
+	username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID
+	mac := hmac.New(sha1.New, []byte(turnSecret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// iceToken returns the token a user presents to fetch fresh ICE credentials
+// until expiresAt. Like invite tokens it is signed with the host token, so
+// every node accepts it.
+func (room *Room) iceToken(userID string, expiresAt time.Time) string {
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(room.HostToken))
+	mac.Write([]byte(room.ID + ":ice:" + userID + ":" + expiry))
+	return userID + "." + expiry + "." + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// iceTokenUser returns the user an ICE token was issued to, or "" if the
+// token is not valid for this room or has expired
+func (room *Room) iceTokenUser(token string) string {
+	userID, rest, _ := strings.Cut(token, ".")
+	expiry, _, ok := strings.Cut(rest, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if !ok || err != nil || time.Now().Unix() >= unix {
+		return ""
+	}
+	if !hmac.Equal([]byte(token), []byte(room.iceToken(userID, time.Unix(unix, 0)))) {
+		return ""
+	}
+	return userID
+}
+
+// inRoom reports whether a user is connected to the room on any node, or
+// away with a resumable session
+func (room *Room) inRoom(userID string) (bool, error) {
+	users, err := backplane.Presence(room.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, user := range users {
+		if user.ID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// iceConfig builds the ICE servers for a user, or nil when none are configured
+func (room *Room) iceConfig(userID string) *ICEConfig {
+	if len(stunServers) == 0 && len(turnServers) == 0 {
+		return nil
+	}
+
+	// The token expires with the credentials it comes with, so clients use
+	// the latest one to refresh
+	expiresAt := time.Now().Add(turnCredentialTTL)
+	config := &ICEConfig{
+		ICEServers: make([]ICEServer, 0, 2),
+		Token:      room.iceToken(userID, expiresAt),
+	}
+	if len(stunServers) > 0 {
+		config.ICEServers = append(config.ICEServers, ICEServer{URLs: stunServers})
+	}
+	if len(turnServers) > 0 {
+		username, credential := turnCredentials(userID, expiresAt)
+		config.ICEServers = append(config.ICEServers, ICEServer{
+			URLs:       turnServers,
+			Username:   username,
+			Credential: credential,
+		})
+		config.ExpiresAt = &expiresAt
+	}
+	return config
+}
+
+// GetICEServers returns fresh ICE server configuration for a user in the
+// room, authenticated with the ICE token from the join sync
+func GetICEServers(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	userID := room.iceTokenUser(r.Header.Get("X-Ice-Token"))
+	if userID == "" {
+		http.Error(w, "Invalid or expired ICE token", http.StatusForbidden)
+		return
+	}
+
+	// A token outlives the connection it was issued to, so users who left
+	// get no more TURN credentials
+	present, err := room.inRoom(userID)
+	if err != nil {
+		log.Printf("Room %s: presence lookup failed: %v", room.ID, err)
+		http.Error(w, "Failed to check room presence", http.StatusServiceUnavailable)
+		return
+	}
+	if !present {
+		http.Error(w, "Not in the room", http.StatusForbidden)
+		return
+	}
+
+	config := room.iceConfig(userID)
+	if config == nil {
+		config = &ICEConfig{ICEServers: []ICEServer{}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(config)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestICETokenExpiryAndPresence checks fresh ICE credentials need an
+// unexpired token from a user still in the room
+func TestICETokenExpiryAndPresence(t *testing.T) {
+	stunServers = []string{"stun:stun.example.com:3478"}
+	t.Cleanup(func() { stunServers = nil })
+
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	conn, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var sync SyncData
+	json.Unmarshal(readUntil(t, conn, MessageTypeSync).Data, &sync)
+	if sync.ICE == nil || sync.ICE.Token == "" {
+		t.Fatal("join sync has no ICE token")
+	}
+	token := sync.ICE.Token
+	userID, _, _ := strings.Cut(token, ".")
+
+	fetch := func(token string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+"/api/rooms/"+room.ID+"/ice", nil)
+		req.Header.Set("X-Ice-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get ice: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := fetch(token); status != http.StatusOK {
+		t.Fatalf("valid token: status %d", status)
+	}
+
+	// Moving the expiry forward breaks the signature
+	parts := strings.Split(token, ".")
+	parts[1] = "9999999999"
+	if status := fetch(strings.Join(parts, ".")); status != http.StatusForbidden {
+		t.Fatalf("tampered expiry: status %d, want %d", status, http.StatusForbidden)
+	}
+	if status := fetch(room.iceToken(userID, time.Now().Add(-time.Minute))); status != http.StatusForbidden {
+		t.Fatalf("expired token: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"leave"}`))
+	deadline := time.Now().Add(5 * time.Second)
+	for room.Snapshot().Info.UserCount != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client never left")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status := fetch(token); status != http.StatusForbidden {
+		t.Fatalf("token of a user who left: status %d, want %d", status, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultRoomIdleTimeout     = 30 * time.Minute
+	defaultRoomCleanupInterval = 1 * time.Minute
+	// maxCloseReasonBytes keeps close reasons within a WebSocket control frame
+	maxCloseReasonBytes = 120
+)
+
+var (
+	// Server-wide idle policy, used by rooms that do not set their own
+	roomIdleTimeout     = defaultRoomIdleTimeout
+	roomCleanupInterval = defaultRoomCleanupInterval
+)
+
+// ConfigureRoomLifecycle reads the server idle policy from ROOM_IDLE_TIMEOUT
+// and ROOM_CLEANUP_INTERVAL, given as Go durations such as "45m" or "30s"
+func ConfigureRoomLifecycle() error {
+	if err := durationEnv("ROOM_IDLE_TIMEOUT", &roomIdleTimeout); err != nil {
+		return err
+	}
+	return durationEnv("ROOM_CLEANUP_INTERVAL", &roomCleanupInterval)
+}
+
+func durationEnv(name string, value *time.Duration) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid %s %q", name, v)
+	}
+	*value = d
+	return nil
+}
+
+// idleTimeout returns how long the room may stay empty before it is closed
+func (room *Room) idleTimeout() time.Duration {
+	if room.Settings.IdleTimeoutSeconds > 0 {
+		return time.Duration(room.Settings.IdleTimeoutSeconds) * time.Second
+	}
+	return roomIdleTimeout
+}
+
+// cleanupInterval returns how often Run checks whether the room is idle
+func (room *Room) cleanupInterval() time.Duration {
+	if room.Settings.CleanupIntervalSeconds > 0 {
+		return time.Duration(room.Settings.CleanupIntervalSeconds) * time.Second
+	}
+	return roomCleanupInterval
+}
+
+// idle reports whether the room has had no users on this node for longer
+// than its idle timeout. Scheduled rooms wait for their opening first.
+func (room *Room) idle() bool {
+	if len(room.Clients) > 0 || room.scheduled() {
+		return false
+	}
+	return time.Since(room.LastActivity) > room.idleTimeout()
+}
+
+// scheduled reports whether the room is still waiting for its opening time
+func (room *Room) scheduled() bool {
+	return time.Now().Before(room.OpensAt)
+}
+
+// countdownMessage builds the countdown message for a scheduled room
+func (room *Room) countdownMessage(secondsLeft int) []byte {
+	return mustMarshal(Message{
+		Type:   MessageTypeCountdown,
+		RoomID: room.ID,
+		Data: mustMarshal(CountdownData{
+			OpensAt:     room.OpensAt,
+			SecondsLeft: secondsLeft,
+		}),
+		Timestamp: time.Now(),
+	})
+}
+
+// secondsUntilOpen returns the whole seconds left before the room opens
+func (room *Room) secondsUntilOpen() int {
+	return int(math.Ceil(time.Until(room.OpensAt).Seconds()))
+}
+
+// sendCountdown tells a client joining a scheduled room when it opens
+func (room *Room) sendCountdown(client *Client) {
+	client.send(room.countdownMessage(room.secondsUntilOpen()))
+}
+
+// tickCountdown announces the time left every minute, then every second for
+// the final ten seconds, and opens the room when it is due. Every node runs
+// its own countdown, so these messages are delivered locally only.
+func (room *Room) tickCountdown() (opened bool) {
+	left := room.secondsUntilOpen()
+	if left <= 0 {
+		room.open()
+		return true
+	}
+
+	if left <= 10 || left%60 == 0 {
+		room.deliver(room.countdownMessage(left))
+	}
+	return false
+}
+
+// open lets clients start playback in a scheduled room
+func (room *Room) open() {
+	room.LastActivity = time.Now() // The idle timeout starts at opening
+	room.deliver(mustMarshal(Message{
+		Type:      MessageTypeRoomOpen,
+		RoomID:    room.ID,
+		Timestamp: time.Now(),
+	}))
+	log.Printf("Room %s: scheduled room opened", room.ID)
+}
+
+// shutdown tells every client on this node the room is closed, disconnects
+// them with reason and makes Run stop. When announce is set the closure is
+// published so the other nodes shut their replicas down too.
+func (room *Room) shutdown(reason string, announce bool) {
+	msg := mustMarshal(Message{
+		Type:      MessageTypeRoomClosed,
+		RoomID:    room.ID,
+		Data:      mustMarshal(RoomClosedData{Reason: reason}),
+		Timestamp: time.Now(),
+	})
+	room.deliver(msg)
+	if announce {
+		room.publish(msg)
+	}
+
+	for client := range room.Clients {
+		client.closeCode = websocket.CloseNormalClosure
+		client.closeReason = reason
+		close(client.Send)
+		delete(room.Clients, client)
+	}
+
+	if room.Proposal != nil && room.Proposal.timer != nil {
+		room.Proposal.timer.Stop()
+	}
+	if room.sfu != nil {
+		room.sfu.close()
+	}
+	room.detachBackplane()
+	room.closed = true
+	log.Printf("Room %s closed: %s", room.ID, reason)
+}
+
+// Close shuts the room down on every node and waits for its Run goroutine to stop
+func (room *Room) Close(reason string) {
+	room.do(func() { room.shutdown(reason, true) })
+	<-room.done
+}
+
+// forgetRoom removes a room from this node's room list
+func forgetRoom(room *Room) {
+	roomsMutex.Lock()
+	if rooms[room.ID] == room {
+		delete(rooms, room.ID)
+	}
+	roomsMutex.Unlock()
+}
+
+// closeReason sanitizes a close reason and trims it to fit a close frame
+func closeReason(text string) string {
+	text = sanitizeText(text)
+	if text == "" {
+		return "Room closed by host"
+	}
+	for len(text) > maxCloseReasonBytes {
+		_, size := utf8.DecodeLastRuneInString(text)
+		text = text[:len(text)-size]
+	}
+	return text
+}
+
+// isHostToken reports whether token is the room's host token, comparing in
+// constant time so the token cannot be guessed from response timings
+func (room *Room) isHostToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(room.HostToken)) == 1
+}
+
+// CloseRoom closes a room for everyone. Only the host may close it, by
+// sending the host token from room creation in the X-Host-Token header.
+func CloseRoom(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if !room.isHostToken(r.Header.Get("X-Host-Token")) {
+		http.Error(w, "Only the host can close the room", http.StatusForbidden)
+		return
+	}
+
+	var req CloseRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	forgetRoom(room)
+	room.Close(closeReason(req.Reason))
+	// Queued behind the room's pending saves, so none publish it again
+	storeWrites <- func() {
+		if err := backplane.DeleteRoom(roomID); err != nil {
+			log.Printf("Failed to delete room %s from the backplane: %v", roomID, err)
+		}
+	}
+	deletePersistedRoom(roomID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
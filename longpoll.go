@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// longPollWait is how long a poll waits for a message before returning empty
+	longPollWait = 25 * time.Second
+	// longPollIdle is how long a long-poll client may go between polls before
+	// it is disconnected; its session stays resumable
+	longPollIdle = 30 * time.Second
+	// maxPollBatch caps the messages returned by one poll
+	maxPollBatch = 100
+)
+
+// longPoller is a client joined by long polling. Its messages wait in the
+// Send channel until the next poll collects them.
+type longPoller struct {
+	client *Client
+	busy   sync.Mutex  // Held by the poll collecting messages
+	idle   *time.Timer // Disconnects the client once it stops polling
+}
+
+var (
+	// longPollers maps resume tokens to long-poll clients
+	longPollers      = make(map[string]*longPoller)
+	longPollersMutex sync.Mutex
+)
+
+// HandleLongPoll joins a room by long polling, for clients that can use
+// neither WebSockets nor event streams. The first request joins with the
+// same query parameters as the WebSocket; later requests send the resume
+// token from the session message in X-Resume-Token. Each reply holds the
+// messages since the previous poll. Clients send their own messages with
+// PostStreamMessage.
+func HandleLongPoll(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	token := r.Header.Get("X-Resume-Token")
+	if token == "" {
+		poller := joinLongPoll(room, r)
+		if poller == nil {
+			http.Error(w, "Room closed", http.StatusGone)
+			return
+		}
+		poller.poll(w, r)
+		return
+	}
+
+	longPollersMutex.Lock()
+	poller := longPollers[token]
+	longPollersMutex.Unlock()
+	if poller == nil || poller.client.Room != room {
+		http.Error(w, "No long poll open for this token; join again with resumeToken", http.StatusGone)
+		return
+	}
+	poller.poll(w, r)
+}
+
+// joinLongPoll registers a long-poll client, returning nil if the room has closed
+func joinLongPoll(room *Room, r *http.Request) *longPoller {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		username = "Anonymous"
+	}
+
+	client := room.newClient(r, username, nil)
+	if !room.register(client) {
+		return nil
+	}
+
+	poller := &longPoller{client: client}
+	poller.idle = time.AfterFunc(longPollIdle, poller.expire)
+
+	token := client.Session.Token
+	longPollersMutex.Lock()
+	longPollers[token] = poller
+	longPollersMutex.Unlock()
+	streamClientsMutex.Lock()
+	streamClients[token] = client
+	streamClientsMutex.Unlock()
+	return poller
+}
+
+// expire disconnects a client that stopped polling
+func (p *longPoller) expire() {
+	p.forget()
+	p.client.Room.unregister(p.client)
+}
+
+// forget removes the client from the long-poll and message routes
+func (p *longPoller) forget() {
+	token := p.client.Session.Token
+
+	longPollersMutex.Lock()
+	if longPollers[token] == p {
+		delete(longPollers, token)
+	}
+	longPollersMutex.Unlock()
+
+	streamClientsMutex.Lock()
+	if streamClients[token] == p.client {
+		delete(streamClients, token)
+	}
+	streamClientsMutex.Unlock()
+}
+
+// poll waits up to longPollWait for messages and replies with all that
+// are ready
+func (p *longPoller) poll(w http.ResponseWriter, r *http.Request) {
+	if !p.busy.TryLock() {
+		http.Error(w, "Another poll is in progress", http.StatusConflict)
+		return
+	}
+	defer p.busy.Unlock()
+
+	p.idle.Stop()
+	client := p.client
+	var collected []outgoing
+	var closed *CloseData
+
+	timeout := time.NewTimer(longPollWait)
+	defer timeout.Stop()
+	select {
+	case out, ok := <-client.Send:
+		if ok {
+			collected = append(collected, out)
+		} else {
+			data := client.closeData()
+			closed = &data
+		}
+	case <-timeout.C:
+	case <-r.Context().Done():
+		p.idle.Reset(longPollIdle)
+		return
+	}
+
+drain:
+	for closed == nil && len(collected) > 0 && len(collected) < maxPollBatch {
+		select {
+		case out, ok := <-client.Send:
+			if !ok {
+				data := client.closeData()
+				closed = &data
+				break drain
+			}
+			collected = append(collected, out)
+		default:
+			break drain
+		}
+	}
+
+	resp := LongPollResponse{Messages: make([]json.RawMessage, 0, len(collected)), Closed: closed}
+	for _, out := range collected {
+		resp.Messages = append(resp.Messages, out.data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err == nil {
+		for _, out := range collected {
+			client.written(out)
+		}
+	}
+
+	if closed != nil {
+		p.forget()
+		return
+	}
+	p.idle.Reset(longPollIdle)
+}
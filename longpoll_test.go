@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// longPoll polls a room, with token when it is set, and returns the reply
+func longPoll(t *testing.T, url, token string) LongPollResponse {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		req.Header.Set("X-Resume-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("poll: status %d", resp.StatusCode)
+	}
+	var reply LongPollResponse
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return reply
+}
+
+// findMessage returns the first message of msgType in a poll reply
+func findMessage(reply LongPollResponse, msgType string) (Message, bool) {
+	for _, data := range reply.Messages {
+		var msg Message
+		json.Unmarshal(data, &msg)
+		if msg.Type == msgType {
+			return msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// TestLongPollJoinsAndExchangesMessages checks a long-poll client joins as a
+// normal user, receives broadcasts and sends messages
+func TestLongPollJoinsAndExchangesMessages(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+	pollURL := server.URL + "/api/rooms/" + room.ID + "/longpoll"
+
+	joined := longPoll(t, pollURL+"?username=tv", "")
+	sessionMsg, ok := findMessage(joined, MessageTypeSession)
+	if !ok {
+		t.Fatal("first poll has no session message")
+	}
+	var session SessionData
+	json.Unmarshal(sessionMsg.Data, &session)
+
+	alice, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer alice.Close()
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"hi tv"}}`))
+	readUntil(t, alice, MessageTypeChat)
+
+	// The join reply may not have had everything; a few polls must bring the chat
+	var chat Message
+	for i := 0; chat.Username != "alice"; i++ {
+		if i == 5 {
+			t.Fatal("long poll never delivered the chat")
+		}
+		chat, _ = findMessage(longPoll(t, pollURL, session.ResumeToken), MessageTypeChat)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/rooms/"+room.ID+"/stream", strings.NewReader(`{"type":"chat","data":{"message":"hi alice"}}`))
+	req.Header.Set("X-Resume-Token", session.ResumeToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	if reply := readUntil(t, alice, MessageTypeChat); reply.Username != "tv" {
+		t.Fatalf("chat from the long-poll client arrived as %+v", reply)
+	}
+}
@@ -14,6 +14,26 @@ func main() {
 	os.MkdirAll("videos", os.ModePerm)
 	os.MkdirAll("thumbnails", os.ModePerm)
 
+	// Open persistent store (enabled by DATA_DIR)
+	if err := OpenStore(); err != nil {
+		log.Fatal("Failed to open data store:", err)
+	}
+	StartStoreWriter()
+	if err := OpenBackplane(); err != nil {
+		log.Fatal("Failed to open backplane:", err)
+	}
+	ConfigureVideoProbe()
+	if err := ConfigureICE(); err != nil {
+		log.Fatal("Failed to configure ICE servers:", err)
+	}
+	if err := ConfigureSFU(); err != nil {
+		log.Fatal("Failed to start SFU:", err)
+	}
+	if err := ConfigureRoomLifecycle(); err != nil {
+		log.Fatal("Failed to configure rooms:", err)
+	}
+	RestoreRooms()
+
 	// Initialize router
 	router := mux.NewRouter()
 
@@ -23,17 +43,31 @@ func main() {
 	// Movie routes
 	api.HandleFunc("/movies", GetMovies).Methods("GET")
 	api.HandleFunc("/movies/{id}", GetMovie).Methods("GET")
+	api.HandleFunc("/movies/{id}/comments", GetComments).Methods("GET")
+	api.HandleFunc("/movies/{id}/comments", CreateComment).Methods("POST")
+	api.HandleFunc("/movies/{id}/comments/{commentId}", DeleteComment).Methods("DELETE")
+	api.HandleFunc("/movies/{id}/reactions", GetReactionHeatmap).Methods("GET")
 	api.HandleFunc("/upload", UploadVideo).Methods("POST")
 
 	// Video streaming routes
 	api.HandleFunc("/videos/{filename}", StreamVideo).Methods("GET")
 	api.HandleFunc("/thumbnails/{filename}", ServeThumbnail).Methods("GET")
+	api.Handle("/hls", NewHLSProxyFromEnv()).Methods("GET", "HEAD")
 
 	// Watch party routes
 	api.HandleFunc("/rooms", CreateRoom).Methods("POST")
 	api.HandleFunc("/rooms", GetActiveRooms).Methods("GET")
 	api.HandleFunc("/rooms/{id}", GetRoom).Methods("GET")
+	api.HandleFunc("/rooms/{id}", CloseRoom).Methods("DELETE")
+	api.HandleFunc("/rooms/{id}/messages", GetRoomMessages).Methods("GET")
+	api.HandleFunc("/rooms/{id}/invites", CreateInvite).Methods("POST")
+	api.HandleFunc("/rooms/{id}/ice", GetICEServers).Methods("GET")
+	api.HandleFunc("/rooms/{id}/events", GetRoomEvents).Methods("GET")
+	api.HandleFunc("/rooms/{id}/replay", ReplayRoom).Methods("POST")
 	api.HandleFunc("/rooms/{id}/ws", HandleWebSocket)
+	api.HandleFunc("/rooms/{id}/stream", HandleEventStream).Methods("GET")
+	api.HandleFunc("/rooms/{id}/stream", PostStreamMessage).Methods("POST")
+	api.HandleFunc("/rooms/{id}/longpoll", HandleLongPoll).Methods("GET")
 
 	// Health check
 	api.HandleFunc("/health", HealthCheck).Methods("GET")
@@ -58,8 +92,7 @@ func main() {
 		port = "8080"
 	}
 
-	// Start room cleanup routine
-	StartRoomCleanup()
+	StartReactionFlush()
 
 	log.Printf("Server starting on port %s", port)
 	log.Printf("Video streaming: http://localhost:%s/api/videos/", port)
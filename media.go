@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Full-mesh calls send every stream to every peer, so only a few users may publish
+	defaultMaxPublishers = 4
+	maxMaxPublishers     = 12
+	maxSDPBytes          = 64 << 10
+	maxCandidateBytes    = 1024
+	maxSDPMidBytes       = 64
+)
+
+// publishing reports whether the peer sends a camera or microphone
+func (peer *MediaPeer) publishing() bool {
+	return peer.Audio || peer.Video
+}
+
+// mediaPublishers returns how many users in the call are publishing
+func (room *Room) mediaPublishers() int {
+	count := 0
+	for _, peer := range room.Media {
+		if peer.publishing() {
+			count++
+		}
+	}
+	return count
+}
+
+// handleMediaMessage processes mediaJoin and mediaLeave
+func (c *Client) handleMediaMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypeMediaJoin:
+		var data MediaJoinData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid mediaJoin")
+			return
+		}
+
+		publish := data.Audio || data.Video
+		if publish && c.Role == RoleSpectator {
+			c.sendError("Spectators can only receive media")
+			return
+		}
+
+		// Changing what an existing publisher sends does not need a new slot
+		current := room.Media[c.ID]
+		if publish && (current == nil || !current.publishing()) && room.mediaPublishers() >= room.Settings.MaxPublishers {
+			c.sendError(fmt.Sprintf("At most %d people can share a camera or microphone at once", room.Settings.MaxPublishers))
+			return
+		}
+
+		if room.Settings.SFU {
+			if err := room.joinSFU(c, data.Audio, data.Video); err != nil {
+				c.sendError(err.Error())
+				return
+			}
+		}
+
+		peer := &MediaPeer{
+			UserID:   c.ID,
+			Username: c.Username,
+			Audio:    data.Audio,
+			Video:    data.Video,
+			JoinedAt: time.Now(),
+		}
+		if current != nil {
+			peer.JoinedAt = current.JoinedAt
+		}
+		room.Media[c.ID] = peer
+		room.broadcastMedia(MessageTypeMediaJoin, peer)
+		if !data.Video && room.Share != nil && room.Share.OwnerID == c.ID {
+			room.stopShare("the broadcaster turned off video")
+		}
+
+		log.Printf("Room %s: %s joined the call (audio: %v, video: %v)", room.ID, c.Username, data.Audio, data.Video)
+
+	case MessageTypeMediaLeave:
+		if room.Media[c.ID] == nil {
+			c.sendError("You are not in the call")
+			return
+		}
+		room.mediaLeave(c.ID)
+	}
+}
+
+// mediaLeave removes a user from the call and tells everyone to close their
+// connections to them
+func (room *Room) mediaLeave(userID string) {
+	peer := room.Media[userID]
+	if peer == nil {
+		return
+	}
+	delete(room.Media, userID)
+	if room.sfu != nil {
+		room.sfu.leave(userID)
+	}
+	room.broadcastMedia(MessageTypeMediaLeave, peer)
+	if room.Share != nil && room.Share.OwnerID == userID {
+		room.stopShare("the broadcaster left the call")
+	}
+
+	log.Printf("Room %s: %s left the call", room.ID, peer.Username)
+}
+
+func (room *Room) broadcastMedia(msgType string, peer *MediaPeer) {
+	room.broadcast(mustMarshal(Message{
+		Type:      msgType,
+		RoomID:    room.ID,
+		UserID:    peer.UserID,
+		Username:  peer.Username,
+		Data:      mustMarshal(peer),
+		Timestamp: time.Now(),
+	}))
+}
+
+// applyRemoteMedia updates the call from another node's mediaJoin or mediaLeave
+func (room *Room) applyRemoteMedia(msg Message) {
+	var peer MediaPeer
+	json.Unmarshal(msg.Data, &peer)
+
+	if msg.Type == MessageTypeMediaJoin {
+		room.Media[peer.UserID] = &peer
+	} else {
+		delete(room.Media, peer.UserID)
+	}
+}
+
+// sendMediaPeers sends the users in the call to a client joining the room
+func (room *Room) sendMediaPeers(client *Client) {
+	peers := make([]*MediaPeer, 0, len(room.Media))
+	for _, peer := range room.Media {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].JoinedAt.Before(peers[j].JoinedAt) })
+
+	msg := Message{
+		Type:   MessageTypeMediaPeers,
+		RoomID: room.ID,
+		Data: mustMarshal(MediaPeersData{
+			Peers:         peers,
+			MaxPublishers: room.Settings.MaxPublishers,
+		}),
+		Timestamp: time.Now(),
+	}
+
+	client.send(mustMarshal(msg))
+}
+
+// handleSignal checks a WebRTC offer, answer or ICE candidate and forwards
+// it to its target. Both users must be in the call, and an offer needs one
+// of them to be publishing. In SFU rooms clients only signal the SFU.
+func (c *Client) handleSignal(msg Message) {
+	room := c.Room
+
+	if msg.To == "" || msg.To == c.ID {
+		c.sendError("Signaling messages need a 'to' peer")
+		return
+	}
+	sender := room.Media[c.ID]
+	if sender == nil {
+		c.sendError("Join the call with mediaJoin before signaling")
+		return
+	}
+
+	if room.Settings.SFU {
+		if msg.To != sfuPeerID {
+			c.sendError("Calls in this room go through the server; signal \"" + sfuPeerID + "\"")
+			return
+		}
+		data, problem := validSignal(msg)
+		if problem != "" {
+			c.sendError(problem)
+			return
+		}
+		msg.Data = data
+		if room.sfu == nil {
+			c.sendError(errSFUUnavailable.Error())
+			return
+		}
+		if err := room.sfu.signal(c, msg); err != nil {
+			c.sendError(err.Error())
+		}
+		return
+	}
+	target := room.Media[msg.To]
+	if target == nil {
+		c.sendError("Peer " + msg.To + " is not in the call")
+		return
+	}
+	if msg.Type == MessageTypeOffer && !sender.publishing() && !target.publishing() {
+		c.sendError("Neither peer is publishing media")
+		return
+	}
+
+	data, problem := validSignal(msg)
+	if problem != "" {
+		c.sendError(problem)
+		return
+	}
+	msg.Data = data
+
+	c.sendToClient(msg)
+	log.Printf("Room %s: WebRTC %s from %s to %s", room.ID, msg.Type, c.Username, msg.To)
+}
+
+// validSignal checks a signaling payload and returns it with only the known
+// fields, or the problem with it
+func validSignal(msg Message) (json.RawMessage, string) {
+	if msg.Type == MessageTypeIceCandidate {
+		var data IceCandidateData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			return nil, "Invalid ICE candidate"
+		}
+		if len(data.Candidate) > maxCandidateBytes ||
+			(data.Candidate != "" && !strings.HasPrefix(data.Candidate, "candidate:")) {
+			return nil, "Invalid ICE candidate"
+		}
+		if data.SDPMid != nil && len(*data.SDPMid) > maxSDPMidBytes {
+			return nil, "Invalid ICE candidate"
+		}
+		if data.SDPMLineIndex != nil && (*data.SDPMLineIndex < 0 || *data.SDPMLineIndex > 255) {
+			return nil, "Invalid ICE candidate"
+		}
+		if data.UsernameFragment != nil && len(*data.UsernameFragment) > maxSDPMidBytes {
+			return nil, "Invalid ICE candidate"
+		}
+		return mustMarshal(data), ""
+	}
+
+	var data SessionDescriptionData
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		return nil, "Invalid session description"
+	}
+	if data.Type != msg.Type {
+		return nil, "Session description type must match the message type"
+	}
+	if !strings.HasPrefix(data.SDP, "v=0") || len(data.SDP) > maxSDPBytes {
+		return nil, "Invalid session description"
+	}
+	return mustMarshal(data), ""
+}
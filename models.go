@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,29 +18,197 @@ type Movie struct {
 	CreatedAt   time.Time `json:"createdAt"`
 }
 
-// Room represents a watch party room
+// Comment represents a comment pinned to a playback position in a movie
+type Comment struct {
+	ID        string    `json:"id"`
+	MovieID   string    `json:"movieId"`
+	Offset    float64   `json:"offset"` // Playback position in seconds
+	Username  string    `json:"username"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Room represents a watch party room. Its state is owned by the Run goroutine;
+// other goroutines send work through the channels and read Snapshot.
 type Room struct {
-	ID             string           `json:"id"`
-	MovieID        string           `json:"movieId"`
-	CustomVideoURL string           `json:"customVideoUrl,omitempty"` // Added for custom m3u8 links
-	HostID         string           `json:"hostId"`
-	Name           string           `json:"name"`
-	Clients        map[*Client]bool `json:"-"`
-	VideoState     *VideoState      `json:"videoState"`
-	CreatedAt      time.Time        `json:"createdAt"`
-	LastActivity   time.Time        `json:"-"`
-	Broadcast      chan []byte      `json:"-"`
-	Register       chan *Client     `json:"-"`
-	Unregister     chan *Client     `json:"-"`
+	ID             string                `json:"id"`
+	MovieID        string                `json:"movieId"`
+	CustomVideoURL string                `json:"customVideoUrl,omitempty"` // Added for custom m3u8 links
+	HostID         string                `json:"hostId"`
+	HostToken      string                `json:"-"` // Lets the creator claim HostID over WebSocket
+	Name           string                `json:"name"`
+	Settings       *RoomSettings         `json:"settings"`
+	Clients        map[*Client]bool      `json:"-"`
+	VideoState     *VideoState           `json:"videoState"`
+	NowPlaying     *QueueItem            `json:"nowPlaying,omitempty"`
+	Queue          []*QueueItem          `json:"queue"`             // Up-next items, in play order
+	OpensAt        time.Time             `json:"opensAt,omitempty"` // Scheduled rooms reject playback until this time
+	CreatedAt      time.Time             `json:"createdAt"`
+	LastActivity   time.Time             `json:"-"`
+	dirty          atomic.Bool           // State changed since it was last persisted
+	Proposal       *VoteProposal         `json:"-"`
+	ReadyCheck     *ReadyCheck           `json:"-"`
+	Polls          map[string]*Poll      `json:"-"` // Open polls by ID
+	Media          map[string]*MediaPeer `json:"-"` // Users in the WebRTC call by user ID
+	sfu            roomSFU               // Forwards the call's media in SFU rooms
+	Share          *Share                `json:"-"` // Active live share, if any
+	shareResume    *VideoState           // Video state to return to when the share stops
+	countdown      *playCountdown        // Pending countdown to a group play
+	endedReports   map[string]bool       // Clients that reported NowPlaying finished, by client ID
+	Sessions       map[string]*Session   `json:"-"` // Resume token -> session
+	sessionsMutex  sync.Mutex
+	History        *messageRing `json:"-"` // Recent broadcasts for replay on resume
+	Chat           []Message    `json:"-"` // Recent chat messages, oldest first
+	chatMutex      sync.Mutex
+	Events         []RoomEvent `json:"-"` // Recent event log entries, oldest first
+	eventsMutex    sync.Mutex
+	ReplayOf       string                       `json:"replayOf,omitempty"` // Room whose recorded session this room plays back
+	commentMovie   string                       // Movie the comment cursor belongs to
+	commentCursor  float64                      // Comments before this offset have been pushed
+	reactionCounts map[string]int               // Reactions received in the current window
+	Register       chan *Client                 `json:"-"`
+	Unregister     chan *Client                 `json:"-"`
+	Remote         chan []byte                  `json:"-"` // Broadcasts from other nodes via the backplane
+	Inbound        chan clientMessage           `json:"-"` // Messages read from clients, handled by Run
+	Actions        chan func()                  `json:"-"` // Work scheduled onto Run from other goroutines
+	snapshot       atomic.Pointer[roomSnapshot] // Latest state published by Run for readers
+	unsubscribe    func()                       // Cancels the backplane subscription
+	owner          bool                         // This node owns the room's persisted state
+	closed         bool                         // Run stops after the current event
+	done           chan struct{}                // Closed once Run has stopped
+}
+
+// RoomEvent is one entry of a room's append-only event log
+type RoomEvent struct {
+	Time     time.Time       `json:"time"` // Server time the event happened
+	Kind     string          `json:"kind"` // state, broadcast, join or leave
+	UserID   string          `json:"userId,omitempty"`
+	Username string          `json:"username,omitempty"`
+	Message  json.RawMessage `json:"message,omitempty"` // The broadcast, or the sync state for state events
+}
+
+// clientMessage is a raw message read from a client's connection
+type clientMessage struct {
+	client *Client
+	data   []byte
+}
+
+// roomSnapshot is an immutable view of a room, published by Run so other
+// goroutines can read room state without touching the live fields
+type roomSnapshot struct {
+	Info         *RoomInfo
+	LastActivity time.Time
+}
+
+// RoomSettings holds per-room control options
+type RoomSettings struct {
+	HostOnlyControl   bool    `json:"hostOnlyControl"`   // Only the host may play, pause, seek or skip directly
+	VoteThreshold     float64 `json:"voteThreshold"`     // Fraction of participants needed to pass a vote
+	VoteWindowSeconds int     `json:"voteWindowSeconds"` // How long a vote stays open
+	// Idle policy; 0 uses the server default from ROOM_IDLE_TIMEOUT / ROOM_CLEANUP_INTERVAL
+	IdleTimeoutSeconds     int `json:"idleTimeoutSeconds,omitempty"`     // Close the room after this long without users
+	CleanupIntervalSeconds int `json:"cleanupIntervalSeconds,omitempty"` // How often the room checks whether it is idle
+	// Roles
+	DefaultRole    string `json:"defaultRole"`    // Role of clients joining without an invite: participant or spectator
+	HideSpectators bool   `json:"hideSpectators"` // Leave spectators out of the user list
+	SpectatorChat  bool   `json:"spectatorChat"`  // Let spectators send chat messages
+	// WebRTC call
+	MaxPublishers int  `json:"maxPublishers"` // How many users may send camera or microphone at once
+	SFU           bool `json:"sfu"`           // Route the call through the server instead of a peer mesh
+}
+
+// VoteProposal represents an open participant vote in a room
+type VoteProposal struct {
+	ID         string          `json:"id"`
+	Action     string          `json:"action"`         // "skip" or "seek"
+	Time       float64         `json:"time,omitempty"` // Target time for seek proposals
+	ProposedBy string          `json:"proposedBy"`
+	Yes        int             `json:"yes"`
+	No         int             `json:"no"`
+	Required   int             `json:"required"`
+	ExpiresAt  time.Time       `json:"expiresAt"`
+	votes      map[string]bool // Client ID -> approve
+	timer      *time.Timer
+}
+
+// ReadyCheck represents an open ready-check before group playback
+type ReadyCheck struct {
+	ID        string          `json:"id"`
+	StartedBy string          `json:"startedBy"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Ready     []UserInfo      `json:"ready"`
+	NotReady  []UserInfo      `json:"notReady"`
+	Pending   []UserInfo      `json:"pending"` // Participants who have not answered yet
+	responses map[string]bool // Client ID -> ready
+	timer     *time.Timer
+}
+
+// Poll represents a question asked to the room
+type Poll struct {
+	ID            string           `json:"id"`
+	Question      string           `json:"question"`
+	Options       []*PollOption    `json:"options"`
+	Multiple      bool             `json:"multiple"`      // Voters may choose several options
+	Anonymous     bool             `json:"anonymous"`     // Voter names are not shown
+	EnqueueWinner bool             `json:"enqueueWinner"` // Add the winning option's movie to the queue
+	CreatedBy     string           `json:"createdBy"`
+	ExpiresAt     *time.Time       `json:"expiresAt,omitempty"`
+	Voters        int              `json:"voters"`
+	Closed        bool             `json:"closed"`
+	ballots       map[string][]int // Client ID -> chosen option indexes
+	names         map[string]string
+	timer         *time.Timer
+}
+
+// PollOption is one answer of a poll, optionally pointing at a movie or video URL
+type PollOption struct {
+	Text           string     `json:"text"`
+	MovieID        string     `json:"movieId,omitempty"`
+	CustomVideoURL string     `json:"customVideoUrl,omitempty"`
+	Votes          int        `json:"votes"`
+	VotedBy        []UserInfo `json:"votedBy,omitempty"` // Omitted for anonymous polls
+	media          *MediaInfo // Probed details of CustomVideoURL
+}
+
+// playCountdown is a server-driven countdown that ends in a play at playAt
+type playCountdown struct {
+	id     string
+	playAt time.Time
+	timer  *time.Timer
+}
+
+// Session tracks a client identity that can be resumed after a reconnect
+type Session struct {
+	Token          string
+	ClientID       string
+	Username       string
+	Role           string
+	Connected      bool
+	DisconnectedAt time.Time
+	LastSeq        uint64 // Last broadcast sequence delivered before disconnecting
 }
 
 // Client represents a connected user in a room
 type Client struct {
-	ID       string
-	Username string
-	Room     *Room
-	Conn     interface{} // WebSocket connection
-	Send     chan []byte
+	ID           string
+	Username     string
+	Room         *Room
+	Conn         interface{} // *websocket.Conn, or nil for event stream clients
+	Send         chan outgoing
+	protocol     string // ProtocolJSON or ProtocolMsgpack, the encoding of Send
+	Session      *Session
+	Role         string                  // participant or spectator
+	Resumed      bool                    // Reclaimed an existing session on connect
+	Left         bool                    // Sent an explicit leave, so the session is not kept for resume
+	LastTyping   time.Time               // Last typing indicator broadcast, for throttling
+	lastSeq      atomic.Uint64           // Sequence of the last broadcast written to the connection
+	reportedSeq  uint64                  // Last broadcast a reconnecting event stream says it received, or 0
+	limits       map[string]*tokenBucket // Rate limit buckets by message group
+	violations   tokenBucket             // Invalid or rate limited messages, for disconnecting abusers
+	backlog      []outgoing              // Messages held while Send is full, oldest first
+	stalledSince time.Time               // Since when Send has been full without draining; zero while the client keeps up
+	closeCode    int                     // WebSocket close code sent when Send is closed
+	closeReason  string                  // WebSocket close reason sent when Send is closed
 }
 
 // VideoState represents the current state of video playback
@@ -47,27 +217,102 @@ type VideoState struct {
 	CurrentTime  float64   `json:"currentTime"`
 	LastUpdateBy string    `json:"lastUpdateBy"`
 	UpdatedAt    time.Time `json:"updatedAt"`
+	Live         bool      `json:"live,omitempty"` // A live share is playing; seeking is disabled
+}
+
+// QueueItem represents a movie or custom video URL in a room's playlist
+type QueueItem struct {
+	ID             string     `json:"id"`
+	MovieID        string     `json:"movieId,omitempty"`
+	CustomVideoURL string     `json:"customVideoUrl,omitempty"`
+	Title          string     `json:"title"`
+	AddedBy        string     `json:"addedBy"`
+	AddedAt        time.Time  `json:"addedAt"`
+	Media          *MediaInfo `json:"media,omitempty"` // Probed details of a custom video URL
+}
+
+// MediaInfo describes a custom video URL as probed when it was added
+type MediaInfo struct {
+	Format     string      `json:"format"`             // hls, dash, mp4 or webm
+	Duration   float64     `json:"duration,omitempty"` // Seconds; unknown for live streams and plain files
+	Live       bool        `json:"live,omitempty"`
+	Renditions []Rendition `json:"renditions,omitempty"` // Video renditions of a playlist, lowest bandwidth first
+}
+
+// Rendition is one quality level of an HLS or DASH video
+type Rendition struct {
+	Bandwidth int    `json:"bandwidth"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Codecs    string `json:"codecs,omitempty"`
 }
 
 // WebSocket Message Types
 const (
-	MessageTypeJoin     = "join"
-	MessageTypeLeave    = "leave"
-	MessageTypePlay     = "play"
-	MessageTypePause    = "pause"
-	MessageTypeSeek     = "seek"
-	MessageTypeSync     = "sync"
-	MessageTypeChat     = "chat"
-	MessageTypeUserList = "userList"
-	MessageTypeError    = "error"
+	MessageTypeJoin        = "join"
+	MessageTypeLeave       = "leave"
+	MessageTypePlay        = "play"
+	MessageTypePause       = "pause"
+	MessageTypeSeek        = "seek"
+	MessageTypeSync        = "sync"
+	MessageTypeChat        = "chat"
+	MessageTypeChatHistory = "chatHistory" // Server -> client recent chat on join
+	MessageTypeChatEdit    = "chatEdit"
+	MessageTypeChatDelete  = "chatDelete"
+	MessageTypeChatReact   = "chatReact"
+	MessageTypeTyping      = "typing"
+	MessageTypeComments    = "comments"  // Server -> client upcoming timestamped comments
+	MessageTypeReaction    = "reaction"  // Client -> server burst reaction
+	MessageTypeReactions   = "reactions" // Server -> client aggregated reaction counts
+	MessageTypeUserList    = "userList"
+	MessageTypeError       = "error"
+	MessageTypeSession     = "session" // Server -> client identity and resume token
+	MessageTypeSetRole     = "setRole" // Host -> server promote or demote a user
+	MessageTypeRole        = "role"    // Server -> client a user's role changed
+	// Room lifecycle
+	MessageTypeCountdown   = "countdown"   // Server -> client time left before a scheduled room opens
+	MessageTypeRoomOpen    = "roomOpen"    // Server -> client the scheduled room is open
+	MessageTypeRoomClosed  = "roomClosed"  // Server -> client the room was closed
+	MessageTypeReplayEnded = "replayEnded" // Server -> client a replay room reached the end of the recording
+	// Playlist / up-next queue
+	MessageTypeQueue       = "queue" // Server -> client queue update
+	MessageTypeQueueAdd    = "queueAdd"
+	MessageTypeQueueRemove = "queueRemove"
+	MessageTypeQueueMove   = "queueMove"
+	MessageTypeQueueSkip   = "queueSkip"
+	MessageTypeEnded       = "ended" // Client reports the current item finished
+	// Participant voting
+	MessageTypeVotePropose = "votePropose"
+	MessageTypeVote        = "vote"
+	MessageTypeVoteUpdate  = "voteUpdate" // Server -> client tally
+	MessageTypeVoteResult  = "voteResult" // Server -> client outcome
+	// Ready-check and group play countdown
+	MessageTypeReadyCheck    = "readyCheck"    // Host -> server start a ready-check
+	MessageTypeReady         = "ready"         // Client -> server ready / not ready
+	MessageTypeReadyUpdate   = "readyUpdate"   // Server -> client responses so far
+	MessageTypeReadyResult   = "readyResult"   // Server -> client outcome
+	MessageTypePlayCountdown = "playCountdown" // Server -> client 3-2-1 before a scheduled play
+	// Polls
+	MessageTypePollCreate = "pollCreate"
+	MessageTypePollVote   = "pollVote"
+	MessageTypePollClose  = "pollClose"
+	MessageTypePollUpdate = "pollUpdate" // Server -> client poll and tally
+	MessageTypePollResult = "pollResult" // Server -> client closed poll and winner
 	// WebRTC signaling
 	MessageTypeOffer        = "offer"
 	MessageTypeAnswer       = "answer"
 	MessageTypeIceCandidate = "ice-candidate"
+	MessageTypeMediaJoin    = "mediaJoin"  // Join the call or change what is published
+	MessageTypeMediaLeave   = "mediaLeave" // Leave the call
+	MessageTypeMediaPeers   = "mediaPeers" // Server -> client users in the call on join
+	// Live screen or file share
+	MessageTypeShareStart = "shareStart"
+	MessageTypeShareStop  = "shareStop"
 )
 
 // Message represents a WebSocket message
 type Message struct {
+	ID        string          `json:"id,omitempty"` // Server-assigned for chat messages
 	Type      string          `json:"type"`
 	RoomID    string          `json:"roomId,omitempty"`
 	UserID    string          `json:"userId,omitempty"`
@@ -79,7 +324,8 @@ type Message struct {
 
 // PlayPauseData for play/pause events
 type PlayPauseData struct {
-	CurrentTime float64 `json:"currentTime"`
+	CurrentTime float64    `json:"currentTime"`
+	PlayAt      *time.Time `json:"playAt,omitempty"` // Server time a countdown play starts at
 }
 
 // SeekData for seek events
@@ -89,39 +335,376 @@ type SeekData struct {
 
 // ChatData for chat messages
 type ChatData struct {
+	Message   string              `json:"message"`
+	ReplyTo   string              `json:"replyTo,omitempty"`   // ID of the message being replied to
+	Reactions map[string][]string `json:"reactions,omitempty"` // Emoji -> user IDs
+	EditedAt  *time.Time          `json:"editedAt,omitempty"`
+	Deleted   bool                `json:"deleted,omitempty"`
+}
+
+// ChatEditData for editing a chat message
+type ChatEditData struct {
+	MessageID string `json:"messageId"`
+	Message   string `json:"message"`
+}
+
+// ChatDeleteData for deleting a chat message
+type ChatDeleteData struct {
+	MessageID string `json:"messageId"`
+}
+
+// ChatReactData for adding or removing an emoji reaction on a chat message
+type ChatReactData struct {
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove,omitempty"`
+}
+
+// ReactionData for a single burst reaction
+type ReactionData struct {
+	Kind string `json:"kind"` // heart, laugh, shock, ...
+}
+
+// ReactionsData for aggregated reaction broadcasts
+type ReactionsData struct {
+	Counts   map[string]int `json:"counts"`
+	Position float64        `json:"position"` // Playback position the window was recorded at
+}
+
+// ReactionBucket holds reaction totals for one slice of a movie's timeline
+type ReactionBucket struct {
+	Offset float64        `json:"offset"` // Start of the bucket in seconds
+	Counts map[string]int `json:"counts"`
+	Total  int            `json:"total"`
+}
+
+// TypingData for typing indicators
+type TypingData struct {
+	IsTyping bool `json:"isTyping"`
+}
+
+// SessionData for the session message sent on join
+type SessionData struct {
+	UserID      string `json:"userId"`
+	ResumeToken string `json:"resumeToken"`
+	Role        string `json:"role"`
+	Resumed     bool   `json:"resumed"`
+	Replayed    int    `json:"replayed"` // Number of missed messages replayed after this one
+}
+
+// ChatHistoryData for chat history sent on join and by the messages endpoint
+type ChatHistoryData struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`
+}
+
+// CloseData is sent as the close event that ends an event stream
+type CloseData struct {
+	Code   int    `json:"code"` // WebSocket close code
+	Reason string `json:"reason,omitempty"`
+}
+
+// LongPollResponse is the reply to a long poll: the messages that arrived
+// since the last poll, and the close details once the server disconnects
+// the client
+type LongPollResponse struct {
+	Messages []json.RawMessage `json:"messages"`
+	Closed   *CloseData        `json:"closed,omitempty"`
+}
+
+// ErrorData for error messages sent to a single client
+type ErrorData struct {
 	Message string `json:"message"`
 }
 
+// SyncData for the sync message sent on join and when the current item changes.
+// VideoState is embedded so its fields stay at the top level of the payload.
+type SyncData struct {
+	*VideoState
+	NowPlaying *QueueItem   `json:"nowPlaying,omitempty"`
+	Queue      []*QueueItem `json:"queue"`
+	Share      *Share       `json:"share,omitempty"`
+	ICE        *ICEConfig   `json:"ice,omitempty"` // Only in the join-time sync
+}
+
+// ICEConfig is the WebRTC ICE server configuration for one user, shaped
+// like RTCConfiguration
+type ICEConfig struct {
+	ICEServers []ICEServer `json:"iceServers"`
+	ExpiresAt  *time.Time  `json:"expiresAt,omitempty"` // When the TURN credentials expire
+	Token      string      `json:"token,omitempty"`     // Pass as X-Ice-Token to GET /api/rooms/{id}/ice for fresh credentials
+}
+
+// ICEServer is one entry of RTCConfiguration.iceServers
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// QueueData for queue update broadcasts
+type QueueData struct {
+	NowPlaying *QueueItem   `json:"nowPlaying,omitempty"`
+	Queue      []*QueueItem `json:"queue"`
+}
+
+// QueueAddData for adding a movie or custom URL to the queue
+type QueueAddData struct {
+	MovieID        string `json:"movieId,omitempty"`
+	CustomVideoURL string `json:"customVideoUrl,omitempty"`
+	Title          string `json:"title,omitempty"`
+}
+
+// QueueRemoveData for removing an item from the queue
+type QueueRemoveData struct {
+	ItemID string `json:"itemId"`
+}
+
+// QueueMoveData for moving a queue item to a new position
+type QueueMoveData struct {
+	ItemID string `json:"itemId"`
+	Index  int    `json:"index"`
+}
+
+// EndedData for reporting that the current item finished playing
+type EndedData struct {
+	ItemID string `json:"itemId"`
+}
+
+// CountdownData for scheduled room countdown broadcasts
+type CountdownData struct {
+	OpensAt     time.Time `json:"opensAt"`
+	SecondsLeft int       `json:"secondsLeft"`
+}
+
+// RoomClosedData for room closure broadcasts
+type RoomClosedData struct {
+	Reason string `json:"reason"`
+}
+
+// ReadyCheckData for starting a ready-check
+type ReadyCheckData struct {
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// ReadyData for answering the open ready-check
+type ReadyData struct {
+	CheckID string `json:"checkId"`
+	Ready   bool   `json:"ready"`
+}
+
+// ReadyResultData for ready-check outcome broadcasts
+type ReadyResultData struct {
+	Check    *ReadyCheck `json:"check"`
+	AllReady bool        `json:"allReady"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// PlayCountdownData for group play countdown broadcasts
+type PlayCountdownData struct {
+	PlayAt      time.Time `json:"playAt"`
+	CurrentTime float64   `json:"currentTime"`
+	SecondsLeft int       `json:"secondsLeft"`
+	Cancelled   bool      `json:"cancelled,omitempty"`
+}
+
+// PollCreateData for creating a poll
+type PollCreateData struct {
+	Question        string           `json:"question"`
+	Options         []PollOptionData `json:"options"`
+	Multiple        bool             `json:"multiple,omitempty"`
+	Anonymous       bool             `json:"anonymous,omitempty"`
+	EnqueueWinner   bool             `json:"enqueueWinner,omitempty"`
+	DurationSeconds int              `json:"durationSeconds,omitempty"` // Auto-close after this long; 0 keeps it open until closed
+}
+
+// PollOptionData for one option of a new poll
+type PollOptionData struct {
+	Text           string `json:"text,omitempty"`
+	MovieID        string `json:"movieId,omitempty"`
+	CustomVideoURL string `json:"customVideoUrl,omitempty"`
+}
+
+// PollVoteData for voting in a poll; an empty list withdraws the vote
+type PollVoteData struct {
+	PollID  string `json:"pollId"`
+	Options []int  `json:"options"` // Indexes into the poll's options
+}
+
+// PollCloseData for closing a poll
+type PollCloseData struct {
+	PollID string `json:"pollId"`
+}
+
+// PollResultData for closed poll broadcasts
+type PollResultData struct {
+	Poll     *Poll      `json:"poll"`
+	Winner   *int       `json:"winner,omitempty"` // Index of the winning option; omitted on a tie or no votes
+	Enqueued *QueueItem `json:"enqueued,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+}
+
+// VoteProposeData for proposing a skip or seek
+type VoteProposeData struct {
+	Action string  `json:"action"`
+	Time   float64 `json:"time,omitempty"`
+}
+
+// VoteData for casting a vote on the open proposal
+type VoteData struct {
+	ProposalID string `json:"proposalId"`
+	Approve    bool   `json:"approve"`
+}
+
+// VoteResultData for vote outcome broadcasts
+type VoteResultData struct {
+	Proposal *VoteProposal `json:"proposal"`
+	Passed   bool          `json:"passed"`
+	Reason   string        `json:"reason,omitempty"`
+}
+
 // RoomInfo for room details
 type RoomInfo struct {
-	ID             string      `json:"id"`
-	MovieID        string      `json:"movieId"`
-	CustomVideoURL string      `json:"customVideoUrl,omitempty"`
-	Name           string      `json:"name"`
-	HostID         string      `json:"hostId"`
-	UserCount      int         `json:"userCount"`
-	VideoState     *VideoState `json:"videoState"`
-	CreatedAt      time.Time   `json:"createdAt"`
+	ID             string        `json:"id"`
+	MovieID        string        `json:"movieId"`
+	CustomVideoURL string        `json:"customVideoUrl,omitempty"`
+	Name           string        `json:"name"`
+	HostID         string        `json:"hostId"`
+	Settings       *RoomSettings `json:"settings"`
+	UserCount      int           `json:"userCount"`
+	VideoState     *VideoState   `json:"videoState"`
+	NowPlaying     *QueueItem    `json:"nowPlaying,omitempty"`
+	Queue          []*QueueItem  `json:"queue"`
+	Share          *Share        `json:"share,omitempty"`
+	OpensAt        *time.Time    `json:"opensAt,omitempty"`
+	ReplayOf       string        `json:"replayOf,omitempty"`
+	CreatedAt      time.Time     `json:"createdAt"`
 }
 
 // UserInfo for user details
 type UserInfo struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+}
+
+// MediaPeer is a user in the room's WebRTC call
+type MediaPeer struct {
+	UserID   string    `json:"userId"`
+	Username string    `json:"username"`
+	Audio    bool      `json:"audio"` // Publishing a microphone
+	Video    bool      `json:"video"` // Publishing a camera
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// MediaJoinData for joining the call; both false joins to receive only
+type MediaJoinData struct {
+	Audio bool `json:"audio"`
+	Video bool `json:"video"`
+}
+
+// MediaPeersData lists the users in the call for a joining client
+type MediaPeersData struct {
+	Peers         []*MediaPeer `json:"peers"`
+	MaxPublishers int          `json:"maxPublishers"`
+}
+
+// SessionDescriptionData is the payload of offer and answer messages
+type SessionDescriptionData struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// IceCandidateData is the payload of ice-candidate messages. An empty
+// candidate signals the end of candidates.
+type IceCandidateData struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *int    `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// Share is a live stream a broadcaster publishes through the call in place
+// of the room's video
+type Share struct {
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"ownerId"`
+	OwnerName string    `json:"ownerName"`
+	Kind      string    `json:"kind"` // screen or file
+	Title     string    `json:"title,omitempty"`
+	StreamID  string    `json:"streamId,omitempty"` // MediaStream ID of the shared track in the call
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// ShareStartData for starting a share
+type ShareStartData struct {
+	Kind     string `json:"kind"`
+	Title    string `json:"title,omitempty"`
+	StreamID string `json:"streamId,omitempty"`
+}
+
+// ShareStopData announces the end of a share
+type ShareStopData struct {
+	ShareID string `json:"shareId"`
+	Reason  string `json:"reason"`
+}
+
+// RoleData for changing a user's role and for role change broadcasts
+type RoleData struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+// CreateInviteRequest for creating an invite link with a role
+type CreateInviteRequest struct {
+	Role string `json:"role"`
+}
+
+// CreateInviteResponse for invite creation response
+type CreateInviteResponse struct {
+	Role        string `json:"role"`
+	InviteToken string `json:"inviteToken"` // Pass as ?invite= when connecting
 }
 
 // CreateRoomRequest for creating a new room
 type CreateRoomRequest struct {
-	MovieID        string `json:"movieId"`
-	CustomVideoURL string `json:"customVideoUrl,omitempty"`
-	RoomName       string `json:"roomName"`
-	Username       string `json:"username"`
+	MovieID        string        `json:"movieId"`
+	CustomVideoURL string        `json:"customVideoUrl,omitempty"`
+	RoomName       string        `json:"roomName"`
+	Username       string        `json:"username"`
+	Settings       *RoomSettings `json:"settings,omitempty"`
+	OpensAt        *time.Time    `json:"opensAt,omitempty"` // Schedule the room to open at a future time
+}
+
+// ReplayRoomRequest for playing a recorded room session back in a new room
+type ReplayRoomRequest struct {
+	RoomName string `json:"roomName,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// CloseRoomRequest for closing a room; the body is optional
+type CloseRoomRequest struct {
+	Reason string `json:"reason,omitempty"`
 }
 
 // CreateRoomResponse for room creation response
 type CreateRoomResponse struct {
-	Room   *RoomInfo `json:"room"`
-	UserID string    `json:"userId"`
+	Room      *RoomInfo `json:"room"`
+	UserID    string    `json:"userId"`
+	HostToken string    `json:"hostToken"` // Pass as ?hostToken= when connecting to claim host controls
+}
+
+// CreateCommentRequest for pinning a comment to a movie position
+type CreateCommentRequest struct {
+	Username string  `json:"username"`
+	Offset   float64 `json:"offset"`
+	Text     string  `json:"text"`
+}
+
+// CreateCommentResponse for comment creation response
+type CreateCommentResponse struct {
+	Comment     *Comment `json:"comment"`
+	DeleteToken string   `json:"deleteToken"` // Pass as X-Delete-Token to delete the comment
 }
 
 // JoinRoomRequest for joining a room
@@ -20,74 +20,296 @@ var (
 	upgrader   = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    []string{ProtocolMsgpack, ProtocolJSON},
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins in development
 		},
 	}
 )
 
-// Run starts the room's message handling loop
+// Run starts the room's message handling loop. It is the only goroutine that
+// touches the room's live state; everything else either sends it work over a
+// channel or reads the snapshot it publishes after each event.
 func (room *Room) Run() {
-	for {
+	sessionTicker := time.NewTicker(10 * time.Second)
+	defer sessionTicker.Stop()
+	commentTicker := time.NewTicker(1 * time.Second)
+	defer commentTicker.Stop()
+	reactionTicker := time.NewTicker(reactionWindow)
+	defer reactionTicker.Stop()
+	persistTicker := time.NewTicker(2 * time.Second)
+	defer persistTicker.Stop()
+	idleTicker := time.NewTicker(room.cleanupInterval())
+	defer idleTicker.Stop()
+	backlogTicker := time.NewTicker(500 * time.Millisecond)
+	defer backlogTicker.Stop()
+	defer close(room.done)
+
+	// Scheduled rooms count down to their opening time
+	var countdownTick <-chan time.Time
+	if room.scheduled() {
+		countdownTicker := time.NewTicker(time.Second)
+		defer countdownTicker.Stop()
+		countdownTick = countdownTicker.C
+	}
+
+	for !room.closed {
 		select {
 		case client := <-room.Register:
 			room.LastActivity = time.Now() // Update LastActivity
+			if client.Resumed {
+				room.attachSession(client.Session)
+				client.Role = client.Session.Role
+				room.dropStaleConnections(client)
+				// An event stream knows what it received, which may be less
+				// than the old stream wrote
+				if client.reportedSeq > 0 && client.reportedSeq < client.Session.LastSeq {
+					client.Session.LastSeq = client.reportedSeq
+				}
+				// The new connection has no WebRTC peers yet
+				room.mediaLeave(client.ID)
+				client.lastSeq.Store(client.Session.LastSeq)
+			} else {
+				client.lastSeq.Store(room.History.seq)
+			}
 			room.Clients[client] = true
-			log.Printf("Client %s joined room %s", client.Username, room.ID)
+			room.recordEvent(EventJoin, client, nil)
+			log.Printf("Client %s joined room %s (resumed: %v)", client.Username, room.ID, client.Resumed)
 
-			// Send current video state to new client
+			// Send identity, missed messages and current video state to the client
+			room.sendSession(client)
 			room.sendVideoStateToClient(client)
+			room.sendChatHistory(client)
+			room.sendPolls(client)
+			room.sendMediaPeers(client)
+			if room.scheduled() {
+				room.sendCountdown(client)
+			}
 
-			// Broadcast user list update
-			room.broadcastUserList()
+			// A resumed client never left the user list
+			if !client.Resumed {
+				room.broadcastUserList()
+			}
 
 		case client := <-room.Unregister:
 			room.LastActivity = time.Now() // Update LastActivity
+			// Handle what the client sent before disconnecting, such as an explicit leave
+			room.drainInbound()
+			// Clients the room disconnected itself were already removed
 			if _, ok := room.Clients[client]; ok {
-				delete(room.Clients, client)
-				close(client.Send)
-				log.Printf("Client %s left room %s", client.Username, room.ID)
+				room.removeClient(client)
+			}
 
-				// Broadcast user list update
+		case <-sessionTicker.C:
+			// Refresh ownership and presence on the backplane before they expire
+			room.claimOwnership()
+			if room.expireSessions() {
 				room.broadcastUserList()
+			} else {
+				room.presence()
 			}
 
-		case message := <-room.Broadcast:
-			room.LastActivity = time.Now() // Update LastActivity
-			for client := range room.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(room.Clients, client)
-				}
+		case <-commentTicker.C:
+			if room.owner {
+				room.pushComments()
+			}
+
+		case <-reactionTicker.C:
+			room.flushReactions()
+
+		case <-backlogTicker.C:
+			room.checkSlowConsumers()
+
+		case <-persistTicker.C:
+			if room.owner && room.dirty.Swap(false) {
+				room.persist()
+			}
+
+		case <-countdownTick:
+			if room.tickCountdown() {
+				countdownTick = nil
 			}
+
+		case <-idleTicker.C:
+			if room.idle() {
+				room.shutdown("Room closed after being idle", false)
+				forgetRoom(room)
+				deletePersistedRoom(room.ID)
+			}
+
+		case in := <-room.Inbound:
+			room.handleInbound(in)
+
+		case fn := <-room.Actions:
+			fn()
+
+		case data := <-room.Remote:
+			room.applyRemote(data)
 		}
+
+		room.publishSnapshot()
 	}
 }
 
-func (room *Room) sendVideoStateToClient(client *Client) {
-	syncMsg := Message{
-		Type:      MessageTypeSync,
-		RoomID:    room.ID,
-		Data:      mustMarshal(room.VideoState),
-		Timestamp: time.Now(),
+// removeClient closes a client's Send channel and removes it from the room,
+// updating presence, the call, any ready-check and any open vote
+func (room *Room) removeClient(client *Client) {
+	delete(room.Clients, client)
+	close(client.Send)
+	room.recordEvent(EventLeave, client, nil)
+	log.Printf("Client %s left room %s", client.Username, room.ID)
+
+	// A dropped connection loses its WebRTC peers
+	room.mediaLeave(client.ID)
+
+	// Keep the user listed while their session can still be resumed
+	if !room.detachSession(client) {
+		room.broadcastUserList()
+	}
+	// The remaining clients may now all be ready
+	if room.ReadyCheck != nil {
+		room.tallyReadyCheck()
+	}
+	// A departed client's ballot no longer counts, and fewer votes may pass
+	if room.Proposal != nil {
+		delete(room.Proposal.votes, client.ID)
+		room.tallyProposal()
+	}
+}
+
+// disconnect removes a client from the room and closes its connection with
+// the given WebSocket close code
+func (room *Room) disconnect(client *Client, code int, reason string) {
+	if !room.Clients[client] {
+		return
+	}
+	client.closeCode = code
+	client.closeReason = reason
+	room.removeClient(client)
+}
+
+// Start publishes the room's initial snapshot and starts its Run goroutine.
+// Nothing but Run may touch the room's live state afterwards.
+func (room *Room) Start() {
+	room.recordEvent(EventState, nil, mustMarshal(room.syncMessage()))
+	room.publishSnapshot()
+	go room.Run()
+}
+
+// broadcast delivers a message to every client in the room and to the other
+// nodes. It must be called from Run; other goroutines schedule it with room.do.
+func (room *Room) broadcast(message []byte) {
+	room.LastActivity = time.Now() // Update LastActivity
+	f := newFrame(message)
+	f.seq = room.History.push(message)
+	room.recordEvent(EventBroadcast, nil, message)
+	room.deliverFrame(f)
+	room.publish(message)
+}
+
+// handleInbound processes a message read from a client, dropping it if the
+// client has already left
+func (room *Room) handleInbound(in clientMessage) {
+	if room.Clients[in.client] {
+		in.client.handleMessage(in.data)
 	}
+}
 
-	msgBytes := mustMarshal(syncMsg)
+// drainInbound processes every client message already queued for the room
+func (room *Room) drainInbound() {
+	for {
+		select {
+		case in := <-room.Inbound:
+			room.handleInbound(in)
+		default:
+			return
+		}
+	}
+}
+
+// do schedules fn to run on the room's Run goroutine, unless Run has stopped
+func (room *Room) do(fn func()) {
 	select {
-	case client.Send <- msgBytes:
-	default:
+	case room.Actions <- fn:
+	case <-room.done:
+	}
+}
+
+// publishSnapshot stores a copy of the room's current state for readers on other goroutines
+func (room *Room) publishSnapshot() {
+	room.snapshot.Store(&roomSnapshot{
+		Info:         room.info(),
+		LastActivity: room.LastActivity,
+	})
+}
+
+// Snapshot returns the most recent state published by Run
+func (room *Room) Snapshot() *roomSnapshot {
+	return room.snapshot.Load()
+}
+
+// info builds a copy of the public RoomInfo view of the room. It must be
+// called from Run, or before Run starts.
+func (room *Room) info() *RoomInfo {
+	videoState := *room.VideoState
+	settings := *room.Settings
+
+	info := &RoomInfo{
+		ID:             room.ID,
+		MovieID:        room.MovieID,
+		CustomVideoURL: room.CustomVideoURL,
+		Name:           room.Name,
+		HostID:         room.HostID,
+		Settings:       &settings,
+		UserCount:      len(room.Clients),
+		VideoState:     &videoState,
+		NowPlaying:     room.NowPlaying,
+		Queue:          append(make([]*QueueItem, 0, len(room.Queue)), room.Queue...),
+		Share:          room.Share,
+		ReplayOf:       room.ReplayOf,
+		CreatedAt:      room.CreatedAt,
 	}
+	if room.scheduled() {
+		opensAt := room.OpensAt
+		info.OpensAt = &opensAt
+	}
+	return info
+}
+
+// syncMessage builds the sync message carrying the video state and queue
+func (room *Room) syncMessage() Message {
+	return room.syncMessageWith(nil)
+}
+
+func (room *Room) syncMessageWith(ice *ICEConfig) Message {
+	return Message{
+		Type:   MessageTypeSync,
+		RoomID: room.ID,
+		Data: mustMarshal(SyncData{
+			VideoState: room.VideoState,
+			NowPlaying: room.NowPlaying,
+			Queue:      room.Queue,
+			Share:      room.Share,
+			ICE:        ice,
+		}),
+		Timestamp: time.Now(),
+	}
+}
+
+// sendVideoStateToClient sends a joining client the room state along with
+// its ICE servers, so it can start WebRTC without another request
+func (room *Room) sendVideoStateToClient(client *Client) {
+	syncMsg := room.syncMessageWith(room.iceConfig(client.ID))
+
+	client.send(mustMarshal(syncMsg))
 }
 
 func (room *Room) broadcastUserList() {
-	users := make([]UserInfo, 0, len(room.Clients))
-	for client := range room.Clients {
-		users = append(users, UserInfo{
-			ID:       client.ID,
-			Username: client.Username,
-		})
+	users := make([]UserInfo, 0)
+	for _, user := range room.presence() {
+		if room.listed(user.Role) {
+			users = append(users, user)
+		}
 	}
 
 	msg := Message{
@@ -97,60 +319,108 @@ func (room *Room) broadcastUserList() {
 		Timestamp: time.Now(),
 	}
 
-	room.Broadcast <- mustMarshal(msg)
+	room.broadcast(mustMarshal(msg))
 }
 
-// CreateRoom creates a new watch party room
+// newRoom creates a room with fresh video state and runtime channels
+func newRoom(id string) *Room {
+	return &Room{
+		ID:      id,
+		Clients: make(map[*Client]bool),
+		Queue:   make([]*QueueItem, 0),
+		VideoState: &VideoState{
+			IsPlaying:   false,
+			CurrentTime: 0,
+			UpdatedAt:   time.Now(),
+		},
+		CreatedAt:      time.Now(),
+		LastActivity:   time.Now(),
+		Sessions:       make(map[string]*Session),
+		Polls:          make(map[string]*Poll),
+		Media:          make(map[string]*MediaPeer),
+		History:        newMessageRing(historySize),
+		reactionCounts: make(map[string]int),
+		Register:       make(chan *Client),
+		Unregister:     make(chan *Client),
+		Remote:         make(chan []byte, 256),
+		Inbound:        make(chan clientMessage, 256),
+		Actions:        make(chan func(), 16),
+		done:           make(chan struct{}),
+	}
+}
+
+// jsonError replies with an ErrorData body, like http.Error does in plain text
+func jsonError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorData{Message: message})
+}
+
+// CreateRoom creates a new watch party room. Failures are reported as JSON,
+// like the room it returns on success.
 func CreateRoom(w http.ResponseWriter, r *http.Request) {
 	var req CreateRoomRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		jsonError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.OpensAt != nil && !req.OpensAt.After(time.Now()) {
+		jsonError(w, "opensAt must be in the future", http.StatusBadRequest)
 		return
 	}
 
+	if req.Settings != nil && req.Settings.SFU && !sfuEnabled {
+		jsonError(w, errSFUUnavailable.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Refuse videos that cannot play rather than creating a broken room
+	var media *MediaInfo
+	if req.CustomVideoURL != "" {
+		var err error
+		if media, err = probeVideoURL(r.Context(), req.CustomVideoURL); err != nil {
+			jsonError(w, "customVideoUrl "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
 	roomID := uuid.New().String()[:8]
 	userID := uuid.New().String()[:8]
-
-	room := &Room{
-		ID:             roomID,
-		MovieID:        req.MovieID,
-		CustomVideoURL: req.CustomVideoURL, // Store custom video URL
-		HostID:         userID,
-		Name:           req.RoomName,
-		Clients:        make(map[*Client]bool),
-		VideoState: &VideoState{
-			IsPlaying:   false,
-			CurrentTime: 0,
-			UpdatedAt:   time.Now(),
-		},
-		CreatedAt:    time.Now(),
-		LastActivity: time.Now(),
-		Broadcast:    make(chan []byte, 256),
-		Register:     make(chan *Client),
-		Unregister:   make(chan *Client),
+	settings := normalizeRoomSettings(req.Settings)
+
+	room := newRoom(roomID)
+	room.MovieID = req.MovieID
+	room.CustomVideoURL = req.CustomVideoURL // Store custom video URL
+	room.HostID = userID
+	room.HostToken = uuid.New().String()
+	room.Name = req.RoomName
+	room.Settings = settings
+	room.NowPlaying = newQueueItem(req.MovieID, req.CustomVideoURL, "", req.Username)
+	if room.NowPlaying != nil {
+		room.NowPlaying.Media = media
 	}
+	if req.OpensAt != nil {
+		room.OpensAt = *req.OpensAt
+	}
+	room.attachBackplane()
+	// Saved before the response so other nodes can find the room at once
+	saveRoom(room.ID, mustMarshal(room.record()))
+
+	// Start room goroutine
+	room.Start()
 
 	roomsMutex.Lock()
 	rooms[roomID] = room
 	roomsMutex.Unlock()
 
-	// Start room goroutine
-	go room.Run()
-
 	log.Printf("Room created: %s for movie %s (CustomURL: %s) by %s", roomID, req.MovieID, req.CustomVideoURL, req.Username)
 
 	resp := CreateRoomResponse{
-		Room: &RoomInfo{
-			ID:             room.ID,
-			MovieID:        room.MovieID,
-			CustomVideoURL: room.CustomVideoURL,
-			Name:           room.Name,
-			HostID:         room.HostID,
-			UserCount:      0,
-			VideoState:     room.VideoState,
-			CreatedAt:      room.CreatedAt,
-		},
-		UserID: userID,
+		Room:      room.Snapshot().Info,
+		UserID:    userID,
+		HostToken: room.HostToken,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -162,28 +432,15 @@ func GetRoom(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	roomID := params["id"]
 
-	roomsMutex.RLock()
-	room, exists := rooms[roomID]
-	roomsMutex.RUnlock()
+	room, exists := lookupRoom(roomID)
 
 	if !exists {
 		http.Error(w, "Room not found", http.StatusNotFound)
 		return
 	}
 
-	roomInfo := RoomInfo{
-		ID:             room.ID,
-		MovieID:        room.MovieID,
-		CustomVideoURL: room.CustomVideoURL,
-		Name:           room.Name,
-		HostID:         room.HostID,
-		UserCount:      len(room.Clients),
-		VideoState:     room.VideoState,
-		CreatedAt:      room.CreatedAt,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(roomInfo)
+	json.NewEncoder(w).Encode(room.Snapshot().Info)
 }
 
 // GetActiveRooms returns a list of all active rooms
@@ -193,16 +450,7 @@ func GetActiveRooms(w http.ResponseWriter, r *http.Request) {
 
 	activeRooms := make([]RoomInfo, 0, len(rooms))
 	for _, room := range rooms {
-		activeRooms = append(activeRooms, RoomInfo{
-			ID:             room.ID,
-			MovieID:        room.MovieID,
-			CustomVideoURL: room.CustomVideoURL,
-			Name:           room.Name,
-			HostID:         room.HostID,
-			UserCount:      len(room.Clients),
-			VideoState:     room.VideoState,
-			CreatedAt:      room.CreatedAt,
-		})
+		activeRooms = append(activeRooms, *room.Snapshot().Info)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -219,9 +467,7 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		username = "Anonymous"
 	}
 
-	roomsMutex.RLock()
-	room, exists := rooms[roomID]
-	roomsMutex.RUnlock()
+	room, exists := lookupRoom(roomID)
 
 	if !exists {
 		http.Error(w, "Room not found", http.StatusNotFound)
@@ -234,29 +480,84 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &Client{
-		ID:       uuid.New().String()[:8],
-		Username: username,
-		Room:     room,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
+	client := room.newClient(r, username, conn)
+	if conn.Subprotocol() == ProtocolMsgpack {
+		client.protocol = ProtocolMsgpack
 	}
 
-	room.Register <- client
+	if !room.register(client) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Room closed"))
+		conn.Close()
+		return
+	}
 
 	// Start goroutines for this client
 	go client.writePump()
 	go client.readPump()
 }
 
+// newClient creates a client for a connection to the room, resuming the
+// session named by the resumeToken parameter within its grace window
+func (room *Room) newClient(r *http.Request, username string, conn interface{}) *Client {
+	client := &Client{
+		Room:     room,
+		Conn:     conn,
+		Send:     make(chan outgoing, 256),
+		protocol: ProtocolJSON,
+	}
+
+	// A reconnecting EventSource names its session in Last-Event-ID
+	token := r.URL.Query().Get("resumeToken")
+	if eventToken, seq := lastEventID(r); eventToken != "" {
+		token = eventToken
+		client.reportedSeq = seq
+	}
+
+	// Reclaim the previous identity within the grace window, otherwise start a new session
+	if session := room.claimSession(token); session != nil {
+		client.ID = session.ClientID
+		client.Username = session.Username
+		client.Session = session
+		client.Resumed = true
+	} else {
+		client.ID = uuid.New().String()[:8]
+		if room.isHostToken(r.URL.Query().Get("hostToken")) {
+			client.ID = room.HostID
+		}
+		client.Username = username
+		client.Role = room.joinRole(client.ID == room.HostID, r.URL.Query().Get("invite"))
+		client.Session = room.newSession(client.ID, username, client.Role)
+	}
+	return client
+}
+
+// register adds a client to the room, returning false if the room has closed
+func (room *Room) register(client *Client) bool {
+	select {
+	case room.Register <- client:
+		return true
+	case <-room.done:
+		return false
+	}
+}
+
+// unregister removes a client whose connection has ended
+func (room *Room) unregister(client *Client) {
+	select {
+	case room.Unregister <- client:
+	case <-room.done:
+	}
+}
+
 // readPump pumps messages from WebSocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
-		c.Room.Unregister <- c
+		c.Room.unregister(c)
 		c.Conn.(*websocket.Conn).Close()
 	}()
 
 	conn := c.Conn.(*websocket.Conn)
+	conn.SetReadLimit(maxMessageBytes)
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -271,8 +572,15 @@ func (c *Client) readPump() {
 			}
 			break
 		}
+		if c.protocol == ProtocolMsgpack {
+			message = msgpackToJSON(message)
+		}
 
-		c.handleMessage(message)
+		select {
+		case c.Room.Inbound <- clientMessage{client: c, data: message}:
+		case <-c.Room.done:
+			return
+		}
 	}
 }
 
@@ -288,16 +596,17 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.Send:
+		case out, ok := <-c.Send:
 			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
-				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
 				return
 			}
 
-			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := conn.WriteMessage(frameType(c.protocol), out.data); err != nil {
 				return
 			}
+			c.written(out)
 
 		case <-ticker.C:
 			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -308,11 +617,22 @@ func (c *Client) writePump() {
 	}
 }
 
-// handleMessage processes incoming WebSocket messages
+// handleMessage processes incoming WebSocket messages. It runs on the room's
+// Run goroutine.
 func (c *Client) handleMessage(messageBytes []byte) {
 	var msg Message
 	if err := json.Unmarshal(messageBytes, &msg); err != nil {
-		log.Printf("Invalid message format: %v", err)
+		c.violation("Invalid message")
+		return
+	}
+	if !c.allowMessage(msg.Type) {
+		if !quietLimit(msg.Type) {
+			c.violation("Too many " + msg.Type + " messages, slow down")
+		}
+		return
+	}
+	if err := validatePayload(&msg); err != nil {
+		c.violation(err.Error())
 		return
 	}
 
@@ -320,17 +640,54 @@ func (c *Client) handleMessage(messageBytes []byte) {
 	msg.Username = c.Username
 	msg.Timestamp = time.Now()
 
+	if !c.canSend(msg.Type) {
+		c.sendError("Spectators can only watch")
+		return
+	}
+
+	switch msg.Type {
+	case MessageTypePlay, MessageTypePause, MessageTypeSeek, MessageTypeQueueSkip, MessageTypeEnded, MessageTypeVotePropose, MessageTypeReadyCheck:
+		if c.Room.scheduled() {
+			c.sendError("The room has not opened yet")
+			return
+		}
+	}
+
+	if c.Room.Share != nil {
+		switch msg.Type {
+		case MessageTypeSeek:
+			c.sendError("Seeking is disabled during a live share")
+			return
+		case MessageTypeQueueSkip, MessageTypeEnded:
+			c.sendError("Stop the live share to change the video")
+			return
+		}
+	}
+
+	switch msg.Type {
+	case MessageTypePlay, MessageTypePause, MessageTypeSeek, MessageTypeQueueSkip:
+		if !c.canControl() {
+			c.sendError("Only the host can control playback; propose a vote instead")
+			return
+		}
+		// Manual control overrides a pending group countdown
+		c.Room.cancelPlayCountdown()
+	}
+
 	switch msg.Type {
 	case MessageTypePlay:
 		var data PlayPauseData
 		json.Unmarshal(msg.Data, &data)
 
 		c.Room.VideoState.IsPlaying = true
-		c.Room.VideoState.CurrentTime = data.CurrentTime
+		if !c.Room.VideoState.Live {
+			c.Room.VideoState.CurrentTime = data.CurrentTime
+		}
 		c.Room.VideoState.LastUpdateBy = c.Username
 		c.Room.VideoState.UpdatedAt = time.Now()
 
-		c.Room.Broadcast <- mustMarshal(msg)
+		c.Room.markDirty()
+		c.Room.broadcast(mustMarshal(msg))
 		log.Printf("Room %s: %s played at %.2f", c.Room.ID, c.Username, data.CurrentTime)
 
 	case MessageTypePause:
@@ -338,11 +695,14 @@ func (c *Client) handleMessage(messageBytes []byte) {
 		json.Unmarshal(msg.Data, &data)
 
 		c.Room.VideoState.IsPlaying = false
-		c.Room.VideoState.CurrentTime = data.CurrentTime
+		if !c.Room.VideoState.Live {
+			c.Room.VideoState.CurrentTime = data.CurrentTime
+		}
 		c.Room.VideoState.LastUpdateBy = c.Username
 		c.Room.VideoState.UpdatedAt = time.Now()
 
-		c.Room.Broadcast <- mustMarshal(msg)
+		c.Room.markDirty()
+		c.Room.broadcast(mustMarshal(msg))
 		log.Printf("Room %s: %s paused at %.2f", c.Room.ID, c.Username, data.CurrentTime)
 
 	case MessageTypeSeek:
@@ -353,17 +713,45 @@ func (c *Client) handleMessage(messageBytes []byte) {
 		c.Room.VideoState.LastUpdateBy = c.Username
 		c.Room.VideoState.UpdatedAt = time.Now()
 
-		c.Room.Broadcast <- mustMarshal(msg)
+		c.Room.markDirty()
+		c.Room.broadcast(mustMarshal(msg))
 		log.Printf("Room %s: %s seeked to %.2f", c.Room.ID, c.Username, data.Time)
 
-	case MessageTypeChat:
-		c.Room.Broadcast <- mustMarshal(msg)
-		log.Printf("Room %s: %s: %s", c.Room.ID, c.Username, string(msg.Data))
+	case MessageTypeLeave:
+		// Leaving explicitly ends the session instead of keeping it resumable
+		c.Left = true
+		c.Room.removeClient(c)
+
+	case MessageTypeChat, MessageTypeChatEdit, MessageTypeChatDelete, MessageTypeChatReact, MessageTypeTyping:
+		c.handleChatMessage(msg)
+
+	case MessageTypeQueueAdd, MessageTypeQueueRemove, MessageTypeQueueMove, MessageTypeQueueSkip, MessageTypeEnded:
+		c.handleQueueMessage(msg)
+
+	case MessageTypeReaction:
+		c.handleReaction(msg)
+
+	case MessageTypeVotePropose, MessageTypeVote:
+		c.handleVoteMessage(msg)
+
+	case MessageTypeReadyCheck, MessageTypeReady:
+		c.handleReadyMessage(msg)
+
+	case MessageTypePollCreate, MessageTypePollVote, MessageTypePollClose:
+		c.handlePollMessage(msg)
+
+	case MessageTypeSetRole:
+		c.handleRoleMessage(msg)
+
+	case MessageTypeMediaJoin, MessageTypeMediaLeave:
+		c.handleMediaMessage(msg)
+
+	case MessageTypeShareStart, MessageTypeShareStop:
+		c.handleShareMessage(msg)
 
 	// WebRTC signaling - targeted messages
 	case MessageTypeOffer, MessageTypeAnswer, MessageTypeIceCandidate:
-		c.sendToClient(msg)
-		log.Printf("Room %s: WebRTC %s from %s to %s", c.Room.ID, msg.Type, c.Username, msg.To)
+		c.handleSignal(msg)
 
 	default:
 		log.Printf("Unknown message type: %s", msg.Type)
@@ -380,17 +768,43 @@ func (c *Client) sendToClient(msg Message) {
 	// Find the target client
 	for client := range c.Room.Clients {
 		if client.ID == msg.To {
-			msgBytes := mustMarshal(msg)
-			select {
-			case client.Send <- msgBytes:
-				log.Printf("Sent %s message to client %s", msg.Type, msg.To)
-			default:
-				log.Printf("Failed to send message to client %s (channel full)", msg.To)
-			}
+			client.send(mustMarshal(msg))
+			log.Printf("Sent %s message to client %s", msg.Type, msg.To)
 			return
 		}
 	}
-	log.Printf("Target client %s not found in room %s", msg.To, c.Room.ID)
+	// The target may be connected to another node
+	c.Room.publish(mustMarshal(msg))
+}
+
+// isHost reports whether this client holds the room's host identity
+func (c *Client) isHost() bool {
+	return c.ID == c.Room.HostID
+}
+
+// canControl reports whether this client may play, pause, seek or skip directly
+func (c *Client) canControl() bool {
+	return !c.Room.Settings.HostOnlyControl || c.isHost()
+}
+
+// closeMessage builds the close frame payload sent when the client's Send channel is closed
+func (c *Client) closeMessage() []byte {
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
+
+// sendError sends an error message to this client only
+func (c *Client) sendError(text string) {
+	msg := Message{
+		Type:      MessageTypeError,
+		RoomID:    c.Room.ID,
+		Data:      mustMarshal(ErrorData{Message: text}),
+		Timestamp: time.Now(),
+	}
+
+	c.send(mustMarshal(msg))
 }
 
 // Helper function to marshal JSON
@@ -402,30 +816,3 @@ func mustMarshal(v interface{}) []byte {
 	}
 	return b
 }
-
-// StartRoomCleanup starts a background goroutine to clean up empty rooms
-func StartRoomCleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
-	go func() {
-		for range ticker.C {
-			roomsMutex.Lock()
-			count := 0
-			// Iterate over rooms and check for inactivity
-			for id, room := range rooms {
-				// If room is empty (no clients)
-				if len(room.Clients) == 0 {
-					// And it has been inactive for more than 30 minutes
-					if time.Since(room.LastActivity) > 30*time.Minute {
-						delete(rooms, id)
-						log.Printf("Cleaned up empty room: %s", id)
-						count++
-					}
-				}
-			}
-			roomsMutex.Unlock()
-			if count > 0 {
-				log.Printf("Total rooms cleaned up: %d", count)
-			}
-		}
-	}()
-}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves the room API routes the way main does
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	StartStoreWriter()
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/rooms", CreateRoom).Methods("POST")
+	api.HandleFunc("/rooms", GetActiveRooms).Methods("GET")
+	api.HandleFunc("/rooms/{id}", GetRoom).Methods("GET")
+	api.HandleFunc("/rooms/{id}/ws", HandleWebSocket)
+	api.HandleFunc("/rooms/{id}/events", GetRoomEvents).Methods("GET")
+	api.HandleFunc("/rooms/{id}/replay", ReplayRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/ice", GetICEServers).Methods("GET")
+	api.HandleFunc("/rooms/{id}/stream", HandleEventStream).Methods("GET")
+	api.HandleFunc("/rooms/{id}/stream", PostStreamMessage).Methods("POST")
+	api.HandleFunc("/rooms/{id}/longpoll", HandleLongPoll).Methods("GET")
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// createTestRoom creates a room and closes it when the test ends
+func createTestRoom(t *testing.T, server *httptest.Server) *Room {
+	t.Helper()
+	return createTestRoomWith(t, server, CreateRoomRequest{MovieID: "1", RoomName: "test", Username: "host"})
+}
+
+// createTestRoomWith creates a room from req and closes it when the test ends
+func createTestRoomWith(t *testing.T, server *httptest.Server, req CreateRoomRequest) *Room {
+	t.Helper()
+
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(server.URL+"/api/rooms", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode room: %v", err)
+	}
+	room, ok := lookupRoom(created.Room.ID)
+	if !ok {
+		t.Fatalf("room %s not registered", created.Room.ID)
+	}
+	t.Cleanup(func() {
+		room.Close("test finished")
+		forgetRoom(room)
+	})
+	return room
+}
+
+func dialRoom(t *testing.T, server *httptest.Server, roomID, username string) (*websocket.Conn, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/rooms/" + roomID + "/ws?username=" + username
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	return conn, err
+}
+
+// TestConcurrentJoinLeavePlay runs many clients joining, playing and leaving
+// while room info is read, so go test -race checks Run owns the room state
+func TestConcurrentJoinLeavePlay(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	const clients = 20
+	const readers = 4
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn, err := dialRoom(t, server, room.ID, fmt.Sprintf("user%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			go func() {
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			for j := 0; j < 5; j++ {
+				msgType := MessageTypePlay
+				if j%2 == 1 {
+					msgType = MessageTypePause
+				}
+				msg := fmt.Sprintf(`{"type":%q,"data":{"currentTime":%d}}`, msgType, i*10+j)
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if i%2 == 0 {
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"leave"}`))
+			}
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	var readerWG sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		readerWG.Add(1)
+		go func(i int) {
+			defer readerWG.Done()
+			url := server.URL + "/api/rooms/" + room.ID
+			if i%2 == 1 {
+				url = server.URL + "/api/rooms"
+			}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := http.Get(url)
+				if err != nil {
+					t.Errorf("get %s: %v", url, err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("get %s: status %d", url, resp.StatusCode)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(stop)
+	readerWG.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("client: %v", err)
+	}
+
+	// Every connection is gone once Run has handled the unregisters
+	deadline := time.Now().Add(5 * time.Second)
+	for room.Snapshot().Info.UserCount != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still registered", room.Snapshot().Info.UserCount)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// roomRecord is the persisted form of a room
+type roomRecord struct {
+	ID             string        `json:"id"`
+	Name           string        `json:"name"`
+	HostID         string        `json:"hostId"`
+	HostToken      string        `json:"hostToken"`
+	MovieID        string        `json:"movieId"`
+	CustomVideoURL string        `json:"customVideoUrl,omitempty"`
+	Settings       *RoomSettings `json:"settings"`
+	NowPlaying     *QueueItem    `json:"nowPlaying,omitempty"`
+	Queue          []*QueueItem  `json:"queue"`
+	VideoState     *VideoState   `json:"videoState"`
+	OpensAt        time.Time     `json:"opensAt"`
+	CreatedAt      time.Time     `json:"createdAt"`
+}
+
+// markDirty schedules the room's state to be persisted by its Run loop
+func (room *Room) markDirty() {
+	room.dirty.Store(true)
+}
+
+// record builds the persisted form of the room. A playing video is saved at
+// its current position.
+func (room *Room) record() roomRecord {
+	state := *room.savedVideoState()
+	if state.IsPlaying {
+		state.CurrentTime += time.Since(state.UpdatedAt).Seconds()
+		state.UpdatedAt = time.Now()
+	}
+
+	return roomRecord{
+		ID:             room.ID,
+		Name:           room.Name,
+		HostID:         room.HostID,
+		HostToken:      room.HostToken,
+		MovieID:        room.MovieID,
+		CustomVideoURL: room.CustomVideoURL,
+		Settings:       room.Settings,
+		NowPlaying:     room.NowPlaying,
+		Queue:          room.Queue,
+		VideoState:     &state,
+		OpensAt:        room.OpensAt,
+		CreatedAt:      room.CreatedAt,
+	}
+}
+
+// roomFromRecord recreates a room from its persisted form
+func roomFromRecord(record roomRecord) *Room {
+	room := newRoom(record.ID)
+	room.Name = record.Name
+	room.HostID = record.HostID
+	room.HostToken = record.HostToken
+	room.MovieID = record.MovieID
+	room.CustomVideoURL = record.CustomVideoURL
+	room.Settings = normalizeRoomSettings(record.Settings)
+	room.NowPlaying = record.NowPlaying
+	room.OpensAt = record.OpensAt
+	room.CreatedAt = record.CreatedAt
+	if record.Queue != nil {
+		room.Queue = record.Queue
+	}
+	if record.VideoState != nil {
+		room.VideoState = record.VideoState
+	}
+	room.loadChat()
+	return room
+}
+
+// persist queues the room's metadata and last video state to be saved by the
+// store writer. If the writer is behind, the room stays dirty to retry.
+func (room *Room) persist() {
+	roomID, data := room.ID, mustMarshal(room.record())
+	if !queueStoreWrite("rooms", roomID, func() { saveRoom(roomID, data) }) {
+		room.markDirty()
+	}
+}
+
+// saveRoom writes a room record to the backplane room directory and the store
+func saveRoom(roomID string, data []byte) {
+	if err := backplane.SaveRoom(roomID, data); err != nil {
+		log.Printf("Failed to publish room %s to the backplane: %v", roomID, err)
+	}
+
+	if store == nil {
+		return
+	}
+	if err := store.Put("rooms", roomID, json.RawMessage(data)); err != nil {
+		log.Printf("Failed to persist room %s: %v", roomID, err)
+	}
+}
+
+// deletePersistedRoom removes a room, its chat log and its event log from the
+// store, and the room from the backplane directory once no node has users in
+// it. This is queued behind the room's pending writes, so none recreate it.
+func deletePersistedRoom(roomID string) {
+	storeWrites <- func() {
+		if users, err := backplane.Presence(roomID); err == nil && len(users) == 0 {
+			if err := backplane.DeleteRoom(roomID); err != nil {
+				log.Printf("Failed to delete room %s from the backplane: %v", roomID, err)
+			}
+		}
+
+		if store == nil {
+			return
+		}
+		for _, collection := range []string{"rooms", "chat", "events"} {
+			if err := store.Delete(collection, roomID); err != nil {
+				log.Printf("Failed to delete persisted %s for room %s: %v", collection, roomID, err)
+			}
+		}
+	}
+}
+
+// RestoreRooms recreates the rooms saved in the store and starts their Run loops
+func RestoreRooms() {
+	if store == nil {
+		return
+	}
+
+	ids, err := store.Keys("rooms")
+	if err != nil {
+		log.Printf("Failed to list persisted rooms: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		var record roomRecord
+		if err := store.Get("rooms", id, &record); err != nil {
+			log.Printf("Failed to restore room %s: %v", id, err)
+			continue
+		}
+
+		// Nobody is watching until clients reconnect, so a playing room
+		// comes back paused where it was saved
+		room := roomFromRecord(record)
+		room.VideoState.IsPlaying = false
+		room.VideoState.UpdatedAt = time.Now()
+		room.attachBackplane()
+		room.persist()
+		room.Start()
+
+		roomsMutex.Lock()
+		rooms[room.ID] = room
+		roomsMutex.Unlock()
+	}
+
+	if len(ids) > 0 {
+		log.Printf("Restored %d rooms from the data store", len(ids))
+	}
+}
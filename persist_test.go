@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRestoredRoomIsPaused checks a room saved while playing comes back
+// paused at the position it was saved at
+func TestRestoredRoomIsPaused(t *testing.T) {
+	useTestStore(t)
+
+	saved := newRoom("restore1")
+	saved.Name = "test"
+	saved.Settings = normalizeRoomSettings(nil)
+	saved.VideoState = &VideoState{IsPlaying: true, CurrentTime: 90, UpdatedAt: time.Now().Add(-10 * time.Second)}
+	saved.persist()
+	flushStoreWrites()
+
+	RestoreRooms()
+	room, ok := lookupRoom("restore1")
+	if !ok {
+		t.Fatal("room was not restored")
+	}
+	t.Cleanup(func() {
+		room.Close("test finished")
+		forgetRoom(room)
+	})
+
+	state := room.Snapshot().Info.VideoState
+	if state.IsPlaying {
+		t.Fatal("restored room is playing")
+	}
+	if state.CurrentTime < 99 || state.CurrentTime > 101 {
+		t.Fatalf("restored at %.1fs, want about 100s", state.CurrentTime)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxOpenPolls        = 5
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollQuestion     = 200 // characters
+	maxPollOption       = 100 // characters
+	maxPollDurationSecs = 24 * 60 * 60
+)
+
+// handlePollMessage processes poll messages from a client
+func (c *Client) handlePollMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypePollCreate:
+		if !c.isHost() {
+			c.sendError("Only the host can create polls")
+			return
+		}
+
+		var data PollCreateData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid poll")
+			return
+		}
+		if len(room.Polls) >= maxOpenPolls {
+			c.sendError("Too many open polls")
+			return
+		}
+
+		poll, problem := newPoll(data, c.Username)
+		if poll == nil {
+			c.sendError(problem)
+			return
+		}
+
+		if !poll.hasCustomVideos() {
+			c.openPoll(poll, data.DurationSeconds)
+			return
+		}
+
+		// Probing can take seconds, so it runs off Run and the poll opens after
+		go func() {
+			problem := probePollOptions(poll)
+			room.do(func() {
+				if !room.Clients[c] {
+					return
+				}
+				if problem != "" {
+					c.sendError(problem)
+					return
+				}
+				c.openPoll(poll, data.DurationSeconds)
+			})
+		}()
+
+	case MessageTypePollVote:
+		var data PollVoteData
+		json.Unmarshal(msg.Data, &data)
+
+		poll, ok := room.Polls[data.PollID]
+		if !ok {
+			c.sendError("Poll not found or already closed")
+			return
+		}
+
+		choices, problem := poll.validChoices(data.Options)
+		if problem != "" {
+			c.sendError(problem)
+			return
+		}
+
+		if len(choices) == 0 {
+			delete(poll.ballots, c.ID)
+		} else {
+			poll.ballots[c.ID] = choices
+			poll.names[c.ID] = c.Username
+		}
+		room.broadcastPoll(poll)
+
+	case MessageTypePollClose:
+		if !c.isHost() {
+			c.sendError("Only the host can close polls")
+			return
+		}
+
+		var data PollCloseData
+		json.Unmarshal(msg.Data, &data)
+
+		if _, ok := room.Polls[data.PollID]; !ok {
+			c.sendError("Poll not found or already closed")
+			return
+		}
+		room.closePoll(data.PollID, "")
+	}
+}
+
+// openPoll starts a validated poll and announces it. It must be called from Run.
+func (c *Client) openPoll(poll *Poll, durationSeconds int) {
+	room := c.Room
+	if !c.isHost() {
+		c.sendError("Only the host can create polls")
+		return
+	}
+	if len(room.Polls) >= maxOpenPolls {
+		c.sendError("Too many open polls")
+		return
+	}
+
+	if durationSeconds > 0 {
+		duration := time.Duration(durationSeconds) * time.Second
+		expiresAt := time.Now().Add(duration)
+		poll.ExpiresAt = &expiresAt
+		poll.timer = time.AfterFunc(duration, func() {
+			room.do(func() { room.closePoll(poll.ID, "expired") })
+		})
+	}
+	room.Polls[poll.ID] = poll
+
+	log.Printf("Room %s: %s created poll %s", room.ID, c.Username, poll.ID)
+	room.broadcastPoll(poll)
+}
+
+// newPoll validates a poll request and builds the poll. It returns nil and
+// the problem when the request is invalid.
+func newPoll(data PollCreateData, createdBy string) (*Poll, string) {
+	question := sanitizeText(data.Question)
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestion {
+		return nil, "Poll question must be 1-200 characters"
+	}
+	if len(data.Options) < minPollOptions || len(data.Options) > maxPollOptions {
+		return nil, "Polls need between 2 and 10 options"
+	}
+	if data.DurationSeconds < 0 || data.DurationSeconds > maxPollDurationSecs {
+		return nil, "Invalid poll duration"
+	}
+
+	poll := &Poll{
+		ID:            uuid.New().String()[:8],
+		Question:      question,
+		Options:       make([]*PollOption, 0, len(data.Options)),
+		Multiple:      data.Multiple,
+		Anonymous:     data.Anonymous,
+		EnqueueWinner: data.EnqueueWinner,
+		CreatedBy:     createdBy,
+		ballots:       make(map[string][]int),
+		names:         make(map[string]string),
+	}
+
+	for _, option := range data.Options {
+		if option.MovieID != "" && !findMovie(option.MovieID) {
+			return nil, "Movie not found"
+		}
+		if data.EnqueueWinner && option.MovieID == "" && option.CustomVideoURL == "" {
+			return nil, "Queue-linked polls need a movieId or customVideoUrl on every option"
+		}
+
+		text := sanitizeText(option.Text)
+		if text == "" {
+			// Options linked to a movie or video default to its title
+			if item := newQueueItem(option.MovieID, option.CustomVideoURL, "", ""); item != nil {
+				text = item.Title
+			}
+		}
+		if text == "" || utf8.RuneCountInString(text) > maxPollOption {
+			return nil, "Poll options must be 1-100 characters"
+		}
+
+		poll.Options = append(poll.Options, &PollOption{
+			Text:           text,
+			MovieID:        option.MovieID,
+			CustomVideoURL: option.CustomVideoURL,
+		})
+	}
+
+	return poll, ""
+}
+
+// hasCustomVideos reports whether any option links to a custom video URL
+func (poll *Poll) hasCustomVideos() bool {
+	for _, option := range poll.Options {
+		if option.CustomVideoURL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// probePollOptions probes the options' custom video URLs in parallel and
+// keeps their details for when the winner is enqueued. It returns the
+// problem with the first unplayable option, or "".
+func probePollOptions(poll *Poll) string {
+	var wg sync.WaitGroup
+	errs := make([]error, len(poll.Options))
+	for i, option := range poll.Options {
+		if option.CustomVideoURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, option *PollOption) {
+			defer wg.Done()
+			option.media, errs[i] = probeVideoURL(context.Background(), option.CustomVideoURL)
+		}(i, option)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Sprintf("Poll option %d customVideoUrl %v", i+1, err)
+		}
+	}
+	return ""
+}
+
+// validChoices checks a ballot against the poll and returns it without duplicates
+func (poll *Poll) validChoices(options []int) ([]int, string) {
+	seen := make(map[int]bool, len(options))
+	choices := make([]int, 0, len(options))
+	for _, i := range options {
+		if i < 0 || i >= len(poll.Options) {
+			return nil, "Invalid poll option"
+		}
+		if !seen[i] {
+			seen[i] = true
+			choices = append(choices, i)
+		}
+	}
+	if !poll.Multiple && len(choices) > 1 {
+		return nil, "This poll allows a single choice"
+	}
+	return choices, ""
+}
+
+// tally recounts the poll's ballots
+func (poll *Poll) tally() {
+	for _, option := range poll.Options {
+		option.Votes = 0
+		option.VotedBy = nil
+	}
+
+	for clientID, choices := range poll.ballots {
+		for _, i := range choices {
+			option := poll.Options[i]
+			option.Votes++
+			if !poll.Anonymous {
+				option.VotedBy = append(option.VotedBy, UserInfo{ID: clientID, Username: poll.names[clientID]})
+			}
+		}
+	}
+	for _, option := range poll.Options {
+		sort.Slice(option.VotedBy, func(i, j int) bool { return option.VotedBy[i].Username < option.VotedBy[j].Username })
+	}
+	poll.Voters = len(poll.ballots)
+}
+
+// winner returns the index of the option with the most votes, or -1 when
+// nobody voted or the top options are tied
+func (poll *Poll) winner() int {
+	best, tied := -1, false
+	for i, option := range poll.Options {
+		switch {
+		case option.Votes == 0:
+		case best < 0 || option.Votes > poll.Options[best].Votes:
+			best, tied = i, false
+		case option.Votes == poll.Options[best].Votes:
+			tied = true
+		}
+	}
+	if tied {
+		return -1
+	}
+	return best
+}
+
+// pollMessage builds the update message for a poll
+func (room *Room) pollMessage(poll *Poll) []byte {
+	poll.tally()
+	return mustMarshal(Message{
+		Type:      MessageTypePollUpdate,
+		RoomID:    room.ID,
+		Data:      mustMarshal(poll),
+		Timestamp: time.Now(),
+	})
+}
+
+// broadcastPoll sends a poll's current tally to everyone in the room
+func (room *Room) broadcastPoll(poll *Poll) {
+	room.broadcast(room.pollMessage(poll))
+}
+
+// sendPolls sends the open polls to a client joining the room
+func (room *Room) sendPolls(client *Client) {
+	for _, poll := range room.Polls {
+		client.send(room.pollMessage(poll))
+	}
+}
+
+// closePoll closes an open poll, broadcasts the result and enqueues the
+// winning movie if the poll is linked to the queue
+func (room *Room) closePoll(pollID, reason string) {
+	poll, ok := room.Polls[pollID]
+	if !ok {
+		return
+	}
+	if poll.timer != nil {
+		poll.timer.Stop()
+	}
+	delete(room.Polls, pollID)
+
+	poll.Closed = true
+	poll.tally()
+	result := PollResultData{Poll: poll, Reason: reason}
+
+	if winner := poll.winner(); winner >= 0 {
+		result.Winner = &winner
+		option := poll.Options[winner]
+		if poll.EnqueueWinner && len(room.Queue) < maxQueueLength {
+			// Catalog movies keep their own title in the queue
+			title := option.Text
+			if option.MovieID != "" {
+				title = ""
+			}
+			if item := newQueueItem(option.MovieID, option.CustomVideoURL, title, "poll"); item != nil {
+				item.Media = option.media
+				room.Queue = append(room.Queue, item)
+				result.Enqueued = item
+			}
+		}
+	}
+
+	room.broadcast(mustMarshal(Message{
+		Type:      MessageTypePollResult,
+		RoomID:    room.ID,
+		Data:      mustMarshal(result),
+		Timestamp: time.Now(),
+	}))
+	if result.Enqueued != nil {
+		room.broadcastQueue()
+	}
+
+	log.Printf("Room %s: poll %s closed (winner: %v) %s", room.ID, poll.ID, result.Winner != nil, reason)
+}
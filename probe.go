@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	videoProbeTimeout = 10 * time.Second
+	maxVideoURLLength = 2048
+	maxManifestBytes  = 4 << 20
+)
+
+var (
+	// allowPrivateVideoURLs lets custom videos point at internal addresses,
+	// which is only meant for local development
+	allowPrivateVideoURLs bool
+
+	errPrivateAddress = errors.New("points to a private or internal address")
+)
+
+// deniedNetworks are the address ranges custom video URLs may not resolve to
+var deniedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// ConfigureVideoProbe reads ALLOW_PRIVATE_VIDEO_URLS
+func ConfigureVideoProbe() {
+	allowPrivateVideoURLs = os.Getenv("ALLOW_PRIVATE_VIDEO_URLS") == "true"
+}
+
+func deniedAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range deniedNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeClient fetches custom video URLs. The address check runs when each
+// connection is dialled, so it also covers redirects and DNS rebinding.
+var probeClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if allowPrivateVideoURLs {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				addr, err := netip.ParseAddr(host)
+				if err != nil || deniedAddress(addr) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		ResponseHeaderTimeout: videoProbeTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("redirects to an unsupported scheme")
+		}
+		return nil
+	},
+}
+
+// probeVideoURL checks that a custom video URL is reachable and is an HLS,
+// DASH, MP4 or WebM video, and reads the duration and renditions of
+// playlists. Errors describe the problem for the user.
+func probeVideoURL(ctx context.Context, raw string) (*MediaInfo, error) {
+	if len(raw) > maxVideoURLLength {
+		return nil, errors.New("is too long")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("must be an http or https URL")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, videoProbeTimeout)
+	defer cancel()
+
+	resp, err := probeGet(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := bufio.NewReader(resp.Body)
+	head, _ := body.Peek(512)
+
+	switch format := detectVideoFormat(resp, head); format {
+	case "hls":
+		manifest, err := readManifest(body)
+		if err != nil {
+			return nil, err
+		}
+		return probeHLS(ctx, manifest, resp.Request.URL)
+	case "dash":
+		manifest, err := readManifest(body)
+		if err != nil {
+			return nil, err
+		}
+		return parseDASH(manifest)
+	case "mp4", "webm":
+		return &MediaInfo{Format: format}, nil
+	default:
+		return nil, errors.New("is not an HLS, DASH, MP4 or WebM video")
+	}
+}
+
+// probeGet requests a URL and turns failures into user-facing errors
+func probeGet(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.New("must be an http or https URL")
+	}
+
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return nil, errPrivateAddress
+		}
+		return nil, errors.New("could not be reached")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// detectVideoFormat identifies a response by its content type, the URL
+// extension or the first bytes of the body
+func detectVideoFormat(resp *http.Response, head []byte) string {
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	ext := strings.ToLower(path.Ext(resp.Request.URL.Path))
+
+	switch {
+	case bytes.HasPrefix(head, []byte("#EXTM3U")):
+		return "hls"
+	case bytes.Contains(head, []byte("<MPD")):
+		return "dash"
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return "mp4"
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return "webm"
+	}
+
+	// Fall back to what the server claims when the body is not recognised
+	switch {
+	case strings.Contains(contentType, "mpegurl") || ext == ".m3u8":
+		return "hls"
+	case strings.Contains(contentType, "dash+xml") || ext == ".mpd":
+		return "dash"
+	case strings.HasPrefix(contentType, "video/mp4") || ext == ".mp4" || ext == ".m4v":
+		return "mp4"
+	case strings.HasPrefix(contentType, "video/webm") || ext == ".webm":
+		return "webm"
+	}
+	return ""
+}
+
+func readManifest(r io.Reader) ([]byte, error) {
+	manifest, err := io.ReadAll(io.LimitReader(r, maxManifestBytes+1))
+	if err != nil {
+		return nil, errors.New("could not be read")
+	}
+	if len(manifest) > maxManifestBytes {
+		return nil, errors.New("has a manifest that is too large")
+	}
+	return manifest, nil
+}
+
+// probeHLS reads the renditions of a master playlist and the duration of its
+// first variant, or the duration of a media playlist
+func probeHLS(ctx context.Context, manifest []byte, base *url.URL) (*MediaInfo, error) {
+	info := &MediaInfo{Format: "hls"}
+
+	lines := strings.Split(strings.ReplaceAll(string(manifest), "\r\n", "\n"), "\n")
+	if !strings.HasPrefix(lines[0], "#EXTM3U") {
+		return nil, errors.New("is not a valid HLS playlist")
+	}
+
+	var variant string
+	for i, line := range lines {
+		attrs, ok := strings.CutPrefix(line, "#EXT-X-STREAM-INF:")
+		if !ok {
+			continue
+		}
+
+		rendition := hlsRendition(parseAttributes(attrs))
+		info.Renditions = append(info.Renditions, rendition)
+
+		// The variant URI is the next line that is not a tag
+		if variant == "" {
+			for _, next := range lines[i+1:] {
+				if next = strings.TrimSpace(next); next != "" && !strings.HasPrefix(next, "#") {
+					variant = next
+					break
+				}
+			}
+		}
+	}
+
+	if len(info.Renditions) == 0 {
+		return info, parseHLSMedia(info, lines)
+	}
+	sort.Slice(info.Renditions, func(i, j int) bool { return info.Renditions[i].Bandwidth < info.Renditions[j].Bandwidth })
+
+	ref, err := url.Parse(variant)
+	if variant == "" || err != nil {
+		return nil, errors.New("has a master playlist without variants")
+	}
+	resp, err := probeGet(ctx, base.ResolveReference(ref))
+	if err != nil {
+		return nil, fmt.Errorf("has a variant playlist that %v", err)
+	}
+	defer resp.Body.Close()
+
+	media, err := readManifest(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return info, parseHLSMedia(info, strings.Split(strings.ReplaceAll(string(media), "\r\n", "\n"), "\n"))
+}
+
+// parseHLSMedia adds up the segment durations of a media playlist. Playlists
+// without EXT-X-ENDLIST are live and have no fixed duration.
+func parseHLSMedia(info *MediaInfo, lines []string) error {
+	segments := 0
+	duration := 0.0
+	for _, line := range lines {
+		if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+			value, _, _ = strings.Cut(value, ",")
+			seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return errors.New("is not a valid HLS playlist")
+			}
+			duration += seconds
+			segments++
+		}
+		if strings.HasPrefix(line, "#EXT-X-ENDLIST") {
+			info.Duration = duration
+			return nil
+		}
+	}
+
+	if segments == 0 {
+		return errors.New("has an HLS playlist without segments")
+	}
+	info.Live = true
+	return nil
+}
+
+func hlsRendition(attrs map[string]string) Rendition {
+	rendition := Rendition{Codecs: attrs["CODECS"]}
+	rendition.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+	if width, height, ok := strings.Cut(attrs["RESOLUTION"], "x"); ok {
+		rendition.Width, _ = strconv.Atoi(width)
+		rendition.Height, _ = strconv.Atoi(height)
+	}
+	return rendition
+}
+
+// parseAttributes parses an HLS attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func parseAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		list = rest
+	}
+	return attrs
+}
+
+// dashManifest is the part of a DASH MPD the probe reads
+type dashManifest struct {
+	Type     string `xml:"type,attr"`
+	Duration string `xml:"mediaPresentationDuration,attr"`
+	Periods  []struct {
+		AdaptationSets []struct {
+			MimeType        string `xml:"mimeType,attr"`
+			ContentType     string `xml:"contentType,attr"`
+			Representations []struct {
+				Bandwidth int    `xml:"bandwidth,attr"`
+				Width     int    `xml:"width,attr"`
+				Height    int    `xml:"height,attr"`
+				Codecs    string `xml:"codecs,attr"`
+				MimeType  string `xml:"mimeType,attr"`
+			} `xml:"Representation"`
+		} `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+// parseDASH reads the duration and video renditions of a DASH manifest
+func parseDASH(manifest []byte) (*MediaInfo, error) {
+	var mpd dashManifest
+	if err := xml.Unmarshal(manifest, &mpd); err != nil {
+		return nil, errors.New("is not a valid DASH manifest")
+	}
+
+	info := &MediaInfo{Format: "dash", Live: mpd.Type == "dynamic"}
+	if !info.Live {
+		info.Duration = parseISODuration(mpd.Duration)
+	}
+
+	for _, period := range mpd.Periods {
+		for _, set := range period.AdaptationSets {
+			for _, rep := range set.Representations {
+				video := rep.Width > 0 || strings.HasPrefix(rep.MimeType, "video/") ||
+					strings.HasPrefix(set.MimeType, "video/") || set.ContentType == "video"
+				if video {
+					info.Renditions = append(info.Renditions, Rendition{
+						Bandwidth: rep.Bandwidth,
+						Width:     rep.Width,
+						Height:    rep.Height,
+						Codecs:    rep.Codecs,
+					})
+				}
+			}
+		}
+	}
+	sort.Slice(info.Renditions, func(i, j int) bool { return info.Renditions[i].Bandwidth < info.Renditions[j].Bandwidth })
+
+	return info, nil
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:([\d.]+)S)?)?$`)
+
+// parseISODuration converts an ISO 8601 duration such as PT1H30M12.5S to
+// seconds, returning 0 if it cannot be parsed
+func parseISODuration(value string) float64 {
+	match := isoDurationPattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0
+	}
+
+	seconds := 0.0
+	for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if match[i+1] != "" {
+			n, _ := strconv.ParseFloat(match[i+1], 64)
+			seconds += n * unit
+		}
+	}
+	return seconds
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket subprotocols. Clients pick one with Sec-WebSocket-Protocol;
+// connections without one use JSON.
+const (
+	ProtocolJSON    = "json"    // Text frames holding JSON messages
+	ProtocolMsgpack = "msgpack" // Binary frames holding the same messages as MessagePack maps
+)
+
+// frame is a message on its way to clients. Rooms encode messages as JSON;
+// the MessagePack form is produced once, the first time a client needs it.
+type frame struct {
+	msgType string
+	seq     uint64 // Broadcast sequence number, or 0 for messages outside the history
+	json    []byte
+	msgpack []byte
+}
+
+func newFrame(message []byte) *frame {
+	return &frame{msgType: messageType(message), json: message}
+}
+
+// encode returns the message in a client's protocol
+func (f *frame) encode(protocol string) []byte {
+	if protocol != ProtocolMsgpack {
+		return f.json
+	}
+	if f.msgpack == nil {
+		f.msgpack = jsonToMsgpack(f.json)
+	}
+	return f.msgpack
+}
+
+// jsonToMsgpack converts a JSON message, including its data, to MessagePack.
+// Whole numbers are sent as integers and other numbers as floats.
+func jsonToMsgpack(message []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(message, &v); err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(v); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// msgpackToJSON converts a MessagePack message from a client to the JSON the
+// room handles. Invalid input returns nil, which the room rejects.
+func msgpackToJSON(message []byte) []byte {
+	var v interface{}
+	if err := msgpack.Unmarshal(message, &v); err != nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// frameType returns the WebSocket frame type of a client's protocol
+func frameType(protocol string) int {
+	if protocol == ProtocolMsgpack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxQueueLength limits how many up-next items a room can hold
+const maxQueueLength = 100
+
+// newQueueItem creates a queue item for a catalog movie or a custom video URL.
+// It returns nil when neither is set.
+func newQueueItem(movieID, customVideoURL, title, addedBy string) *QueueItem {
+	if movieID == "" && customVideoURL == "" {
+		return nil
+	}
+
+	if title == "" {
+		title = customVideoURL
+		for _, movie := range movies {
+			if movie.ID == movieID {
+				title = movie.Title
+				break
+			}
+		}
+	}
+
+	return &QueueItem{
+		ID:             uuid.New().String()[:8],
+		MovieID:        movieID,
+		CustomVideoURL: customVideoURL,
+		Title:          title,
+		AddedBy:        addedBy,
+		AddedAt:        time.Now(),
+	}
+}
+
+// findMovie reports whether a movie with the given ID is in the catalog
+func findMovie(movieID string) bool {
+	for _, movie := range movies {
+		if movie.ID == movieID {
+			return true
+		}
+	}
+	return false
+}
+
+// reportEnded records that a client reached the end of NowPlaying and
+// reports whether most connected clients have
+func (room *Room) reportEnded(c *Client) bool {
+	if room.endedReports == nil {
+		room.endedReports = make(map[string]bool)
+	}
+	room.endedReports[c.ID] = true
+
+	reported := 0
+	for client := range room.Clients {
+		if room.endedReports[client.ID] {
+			reported++
+		}
+	}
+	return reported*2 > len(room.Clients)
+}
+
+// queueIndex returns the position of an item in the queue, or -1
+func (room *Room) queueIndex(itemID string) int {
+	for i, item := range room.Queue {
+		if item.ID == itemID {
+			return i
+		}
+	}
+	return -1
+}
+
+// broadcastQueue sends the current queue to everyone in the room
+func (room *Room) broadcastQueue() {
+	room.markDirty()
+
+	msg := Message{
+		Type:   MessageTypeQueue,
+		RoomID: room.ID,
+		Data: mustMarshal(QueueData{
+			NowPlaying: room.NowPlaying,
+			Queue:      room.Queue,
+		}),
+		Timestamp: time.Now(),
+	}
+
+	room.broadcast(mustMarshal(msg))
+}
+
+// advanceQueue makes the next queue item current and resets the video state.
+// It returns false when the queue is empty.
+func (room *Room) advanceQueue(by string, autoplay bool) bool {
+	if len(room.Queue) == 0 {
+		return false
+	}
+
+	next := room.Queue[0]
+	room.Queue = room.Queue[1:]
+	room.NowPlaying = next
+	room.endedReports = nil
+	room.MovieID = next.MovieID
+	room.CustomVideoURL = next.CustomVideoURL
+	room.VideoState = &VideoState{
+		IsPlaying:    autoplay,
+		CurrentTime:  0,
+		LastUpdateBy: by,
+		UpdatedAt:    time.Now(),
+	}
+
+	room.broadcast(mustMarshal(room.syncMessage()))
+	room.broadcastQueue()
+	log.Printf("Room %s: now playing %s (%s)", room.ID, next.Title, next.ID)
+	return true
+}
+
+// queueAdd appends a validated item to the queue. It must be called from Run.
+func (c *Client) queueAdd(data QueueAddData, media *MediaInfo) {
+	room := c.Room
+	if len(room.Queue) >= maxQueueLength {
+		c.sendError("Queue is full")
+		return
+	}
+
+	item := newQueueItem(data.MovieID, data.CustomVideoURL, data.Title, c.Username)
+	item.Media = media
+	room.Queue = append(room.Queue, item)
+	room.broadcastQueue()
+	log.Printf("Room %s: %s queued %s", room.ID, c.Username, item.Title)
+}
+
+// handleQueueMessage processes playlist messages from a client
+func (c *Client) handleQueueMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypeQueueAdd:
+		var data QueueAddData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid queue item")
+			return
+		}
+		if data.MovieID != "" && !findMovie(data.MovieID) {
+			c.sendError("Movie not found")
+			return
+		}
+		if data.MovieID == "" && data.CustomVideoURL == "" {
+			c.sendError("Queue item needs a movieId or customVideoUrl")
+			return
+		}
+		if len(room.Queue) >= maxQueueLength {
+			c.sendError("Queue is full")
+			return
+		}
+
+		if data.CustomVideoURL == "" {
+			c.queueAdd(data, nil)
+			return
+		}
+
+		// Probing can take seconds, so it runs off Run and the item is added after
+		go func() {
+			media, err := probeVideoURL(context.Background(), data.CustomVideoURL)
+			room.do(func() {
+				if !room.Clients[c] {
+					return
+				}
+				if err != nil {
+					c.sendError("customVideoUrl " + err.Error())
+					return
+				}
+				c.queueAdd(data, media)
+			})
+		}()
+
+	case MessageTypeQueueRemove:
+		if !c.canControl() {
+			c.sendError("Only the host can edit the queue")
+			return
+		}
+		var data QueueRemoveData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid queue item")
+			return
+		}
+
+		i := room.queueIndex(data.ItemID)
+		if i < 0 {
+			c.sendError("Queue item not found")
+			return
+		}
+
+		room.Queue = append(room.Queue[:i], room.Queue[i+1:]...)
+		room.broadcastQueue()
+		log.Printf("Room %s: %s removed queue item %s", room.ID, c.Username, data.ItemID)
+
+	case MessageTypeQueueMove:
+		if !c.canControl() {
+			c.sendError("Only the host can edit the queue")
+			return
+		}
+		var data QueueMoveData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid queue move")
+			return
+		}
+
+		i := room.queueIndex(data.ItemID)
+		if i < 0 {
+			c.sendError("Queue item not found")
+			return
+		}
+		if data.Index < 0 || data.Index >= len(room.Queue) {
+			c.sendError("Invalid queue position")
+			return
+		}
+
+		item := room.Queue[i]
+		room.Queue = append(room.Queue[:i], room.Queue[i+1:]...)
+		room.Queue = append(room.Queue[:data.Index], append([]*QueueItem{item}, room.Queue[data.Index:]...)...)
+		room.broadcastQueue()
+		log.Printf("Room %s: %s moved queue item %s to %d", room.ID, c.Username, data.ItemID, data.Index)
+
+	case MessageTypeQueueSkip:
+		if !room.advanceQueue(c.Username, room.VideoState.IsPlaying) {
+			c.sendError("Queue is empty")
+		}
+
+	case MessageTypeEnded:
+		var data EndedData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid ended report")
+			return
+		}
+
+		// Every client reports the end of the item; a report from someone who
+		// may control playback advances the queue, otherwise most of the
+		// room has to agree
+		if room.NowPlaying == nil || data.ItemID != room.NowPlaying.ID {
+			return
+		}
+		if !c.canControl() && !room.reportEnded(c) {
+			return
+		}
+		if !room.advanceQueue(c.Username, true) {
+			room.VideoState.IsPlaying = false
+			room.VideoState.LastUpdateBy = c.Username
+			room.VideoState.UpdatedAt = time.Now()
+			room.markDirty()
+		}
+	}
+}
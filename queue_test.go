@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestQueueAddProbesCustomVideo checks custom videos are probed before they
+// are queued, and unplayable ones are refused
+func TestQueueAddProbesCustomVideo(t *testing.T) {
+	allowPrivateVideoURLs = true
+	t.Cleanup(func() { allowPrivateVideoURLs = false })
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/movie.mp4" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00"))
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	conn, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, MessageTypeSync)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"queueAdd","data":{"customVideoUrl":"`+upstream.URL+`/missing.mp4"}}`))
+	refused := readUntil(t, conn, MessageTypeError)
+	var problem ErrorData
+	json.Unmarshal(refused.Data, &problem)
+	if !strings.HasPrefix(problem.Message, "customVideoUrl ") {
+		t.Fatalf("unplayable video refused with %q", problem.Message)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"queueAdd","data":{"customVideoUrl":"`+upstream.URL+`/movie.mp4"}}`))
+	queued := readUntil(t, conn, MessageTypeQueue)
+	var data QueueData
+	json.Unmarshal(queued.Data, &data)
+	if len(data.Queue) != 1 {
+		t.Fatalf("queue has %d items, want 1", len(data.Queue))
+	}
+	if item := data.Queue[0]; item.Media == nil || item.Media.Format != "mp4" {
+		t.Fatalf("queued item media = %+v, want mp4", item.Media)
+	}
+}
+
+// TestHostOnlyQueueNeedsHostOrMajorityEnded checks participants in a host-only
+// room cannot edit the queue, and their ended reports only advance it once
+// most of the room agrees
+func TestHostOnlyQueueNeedsHostOrMajorityEnded(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoomWith(t, server, CreateRoomRequest{
+		MovieID:  "1",
+		RoomName: "test",
+		Username: "host",
+		Settings: &RoomSettings{HostOnlyControl: true},
+	})
+
+	alice, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer alice.Close()
+	bob, err := dialRoom(t, server, room.ID, "bob")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer bob.Close()
+
+	var state SyncData
+	json.Unmarshal(readUntil(t, alice, MessageTypeSync).Data, &state)
+	readUntil(t, bob, MessageTypeSync)
+	ended := []byte(`{"type":"ended","data":{"itemId":"` + state.NowPlaying.ID + `"}}`)
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"queueAdd","data":{"movieId":"2"}}`))
+	var queued QueueData
+	json.Unmarshal(readUntil(t, alice, MessageTypeQueue).Data, &queued)
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"queueRemove","data":{"itemId":"`+queued.Queue[0].ID+`"}}`))
+	var problem ErrorData
+	json.Unmarshal(readUntil(t, alice, MessageTypeError).Data, &problem)
+	if problem.Message != "Only the host can edit the queue" {
+		t.Fatalf("queueRemove by a participant: %q", problem.Message)
+	}
+
+	// One of two viewers is not enough; the second report advances the queue
+	alice.WriteMessage(websocket.TextMessage, ended)
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","data":{"message":"marker"}}`))
+	readUntil(t, bob, MessageTypeChat)
+	if room.Snapshot().Info.NowPlaying.ID != state.NowPlaying.ID {
+		t.Fatal("one participant's ended report advanced the queue")
+	}
+
+	bob.WriteMessage(websocket.TextMessage, ended)
+	var advanced QueueData
+	json.Unmarshal(readUntil(t, bob, MessageTypeQueue).Data, &advanced)
+	if advanced.NowPlaying == nil || advanced.NowPlaying.ID != queued.Queue[0].ID {
+		t.Fatalf("now playing %+v after both reports, want %s", advanced.NowPlaying, queued.Queue[0].ID)
+	}
+}
+
+// TestCreateRoomProbeErrorIsJSON checks an unplayable customVideoUrl is
+// refused with a JSON error, like CreateRoom's other responses
+func TestCreateRoomProbeErrorIsJSON(t *testing.T) {
+	allowPrivateVideoURLs = true
+	t.Cleanup(func() { allowPrivateVideoURLs = false })
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	server := newTestServer(t)
+
+	body, _ := json.Marshal(CreateRoomRequest{RoomName: "test", Username: "host", CustomVideoURL: upstream.URL + "/missing.mp4"})
+	resp, err := http.Post(server.URL+"/api/rooms", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("content type %q, want application/json", ct)
+	}
+	var problem ErrorData
+	if err := json.NewDecoder(resp.Body).Decode(&problem); err != nil || !strings.HasPrefix(problem.Message, "customVideoUrl ") {
+		t.Fatalf("error body %+v (%v)", problem, err)
+	}
+}
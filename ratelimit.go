@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxMessageBytes is the largest WebSocket frame read from a client; it fits
+// a maximum size SDP offer with room to spare
+const maxMessageBytes = 128 << 10
+
+// rateLimit is a token bucket refilled at rate tokens per second up to burst
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// messageLimitGroups maps message types to the rate limit bucket they draw
+// from; types not listed share the default bucket
+var messageLimitGroups = map[string]string{
+	MessageTypePlay:         "playback",
+	MessageTypePause:        "playback",
+	MessageTypeSeek:         "playback",
+	MessageTypeQueueSkip:    "playback",
+	MessageTypeEnded:        "playback",
+	MessageTypeChat:         "chat",
+	MessageTypeChatEdit:     "chat",
+	MessageTypeChatDelete:   "chat",
+	MessageTypeChatReact:    "chat",
+	MessageTypeTyping:       "typing",
+	MessageTypeReaction:     "reaction",
+	MessageTypeOffer:        "signal",
+	MessageTypeAnswer:       "signal",
+	MessageTypeIceCandidate: "signal",
+}
+
+var (
+	rateLimits = map[string]rateLimit{
+		"playback": {rate: 4, burst: 10},
+		"chat":     {rate: 1, burst: 5},
+		"typing":   {rate: 2, burst: 4},
+		"reaction": {rate: 10, burst: 20},
+		"signal":   {rate: 50, burst: 200}, // ICE candidates arrive in bursts
+		"default":  {rate: 5, burst: 20},
+	}
+
+	// quietLimitGroups are dropped without an error or a violation when over
+	// their limit; holding a key or tapping a reaction is not abuse
+	quietLimitGroups = map[string]bool{
+		"typing":   true,
+		"reaction": true,
+	}
+
+	// violationLimit is how many invalid or rate limited messages a client
+	// may send before it is disconnected
+	violationLimit = rateLimit{rate: 1.0 / 6, burst: 10}
+)
+
+// tokenBucket is the state of one rate limit. Clients' buckets are only used
+// from the room's Run goroutine.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(limit rateLimit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = limit.burst
+	} else {
+		b.tokens = math.Min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowMessage reports whether the client is within the rate limit for msgType
+func (c *Client) allowMessage(msgType string) bool {
+	group, ok := messageLimitGroups[msgType]
+	if !ok {
+		group = "default"
+	}
+	if c.limits == nil {
+		c.limits = make(map[string]*tokenBucket)
+	}
+	bucket := c.limits[group]
+	if bucket == nil {
+		bucket = &tokenBucket{}
+		c.limits[group] = bucket
+	}
+	return bucket.allow(rateLimits[group], time.Now())
+}
+
+// quietLimit reports whether msgType is dropped silently when over its limit
+func quietLimit(msgType string) bool {
+	return quietLimitGroups[messageLimitGroups[msgType]]
+}
+
+// violation tells the client what was wrong with its message, and
+// disconnects it once it keeps sending bad or excessive messages
+func (c *Client) violation(text string) {
+	if c.violations.allow(violationLimit, time.Now()) {
+		c.sendError(text)
+		return
+	}
+
+	log.Printf("Room %s: disconnecting %s after repeated violations (%s)", c.Room.ID, c.Username, text)
+	c.Left = true
+	c.Room.disconnect(c, websocket.ClosePolicyViolation, "Too many invalid or rate-limited messages")
+}
+
+// messagePayloads returns the payload type of each client message, or nil for
+// messages without one
+var messagePayloads = map[string]func() interface{}{
+	MessageTypePlay:         func() interface{} { return &PlayPauseData{} },
+	MessageTypePause:        func() interface{} { return &PlayPauseData{} },
+	MessageTypeSeek:         func() interface{} { return &SeekData{} },
+	MessageTypeLeave:        nil,
+	MessageTypeChat:         func() interface{} { return &ChatData{} },
+	MessageTypeChatEdit:     func() interface{} { return &ChatEditData{} },
+	MessageTypeChatDelete:   func() interface{} { return &ChatDeleteData{} },
+	MessageTypeChatReact:    func() interface{} { return &ChatReactData{} },
+	MessageTypeTyping:       func() interface{} { return &TypingData{} },
+	MessageTypeReaction:     func() interface{} { return &ReactionData{} },
+	MessageTypeQueueAdd:     func() interface{} { return &QueueAddData{} },
+	MessageTypeQueueRemove:  func() interface{} { return &QueueRemoveData{} },
+	MessageTypeQueueMove:    func() interface{} { return &QueueMoveData{} },
+	MessageTypeQueueSkip:    nil,
+	MessageTypeEnded:        func() interface{} { return &EndedData{} },
+	MessageTypeVotePropose:  func() interface{} { return &VoteProposeData{} },
+	MessageTypeVote:         func() interface{} { return &VoteData{} },
+	MessageTypeReadyCheck:   func() interface{} { return &ReadyCheckData{} },
+	MessageTypeReady:        func() interface{} { return &ReadyData{} },
+	MessageTypePollCreate:   func() interface{} { return &PollCreateData{} },
+	MessageTypePollVote:     func() interface{} { return &PollVoteData{} },
+	MessageTypePollClose:    func() interface{} { return &PollCloseData{} },
+	MessageTypeSetRole:      func() interface{} { return &RoleData{} },
+	MessageTypeMediaJoin:    func() interface{} { return &MediaJoinData{} },
+	MessageTypeMediaLeave:   nil,
+	MessageTypeShareStart:   func() interface{} { return &ShareStartData{} },
+	MessageTypeShareStop:    nil,
+	MessageTypeOffer:        func() interface{} { return &SessionDescriptionData{} },
+	MessageTypeAnswer:       func() interface{} { return &SessionDescriptionData{} },
+	MessageTypeIceCandidate: func() interface{} { return &IceCandidateData{} },
+}
+
+// validatePayload checks that a client message has a known type and a
+// payload of the right shape. Playback payloads must carry finite,
+// non-negative times and are rewritten to only the fields clients may set.
+func validatePayload(msg *Message) error {
+	newPayload, known := messagePayloads[msg.Type]
+	if !known {
+		return errors.New("Unknown message type")
+	}
+	if newPayload == nil {
+		return nil
+	}
+
+	payload := newPayload()
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, payload); err != nil {
+			return errors.New("Invalid " + msg.Type + " payload")
+		}
+	}
+
+	switch data := payload.(type) {
+	case *PlayPauseData:
+		if !validTime(data.CurrentTime) {
+			return errors.New("currentTime must be a finite, non-negative number")
+		}
+		msg.Data = mustMarshal(PlayPauseData{CurrentTime: data.CurrentTime})
+	case *SeekData:
+		if !validTime(data.Time) {
+			return errors.New("time must be a finite, non-negative number")
+		}
+		msg.Data = mustMarshal(SeekData{Time: data.Time})
+	}
+	return nil
+}
+
+// validTime reports whether t is a usable playback position in seconds
+func validTime(t float64) bool {
+	return t >= 0 && !math.IsInf(t, 0) && !math.IsNaN(t)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func newTestClient(room *Room) *Client {
+	client := &Client{
+		ID:       "user1",
+		Username: "user1",
+		Room:     room,
+		Send:     make(chan outgoing, 256),
+		Role:     RoleParticipant,
+		protocol: ProtocolJSON,
+	}
+	client.Session = room.newSession(client.ID, client.Username, client.Role)
+	room.Clients[client] = true
+	return client
+}
+
+func TestQuietLimitsDoNotDisconnect(t *testing.T) {
+	room := newRoom("quiet")
+	room.Settings = normalizeRoomSettings(nil)
+	client := newTestClient(room)
+
+	for i := 0; i < 200; i++ {
+		client.handleMessage([]byte(`{"type":"typing","data":{"isTyping":true}}`))
+		client.handleMessage([]byte(`{"type":"reaction","data":{"kind":"heart"}}`))
+	}
+	if !room.Clients[client] {
+		t.Fatal("client flooding typing and reactions was disconnected")
+	}
+
+	for i := 0; i < 100 && room.Clients[client]; i++ {
+		client.handleMessage([]byte(`{"type":"chat","data":{"message":"spam"}}`))
+	}
+	if room.Clients[client] {
+		t.Fatal("client flooding chat was not disconnected")
+	}
+	if client.closeCode != 1008 {
+		t.Fatalf("close code = %d, want 1008", client.closeCode)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// reactionWindow is how long Run collects reactions before broadcasting counts
+	reactionWindow = 500 * time.Millisecond
+	// reactionBucketSeconds is the timeline resolution of stored reaction totals
+	reactionBucketSeconds = 5
+)
+
+// reactionKinds are the burst reactions clients may send
+var reactionKinds = map[string]bool{
+	"heart": true,
+	"laugh": true,
+	"shock": true,
+	"clap":  true,
+	"fire":  true,
+	"sad":   true,
+}
+
+var (
+	// reactionTotals maps MovieID -> bucket index -> kind -> count
+	reactionTotals = make(map[string]map[int]map[string]int)
+	reactionDirty  = make(map[string]bool) // Movies with totals not yet persisted
+	reactionsMutex sync.Mutex
+)
+
+// handleReaction counts a burst reaction towards the current aggregation window
+func (c *Client) handleReaction(msg Message) {
+	var data ReactionData
+	json.Unmarshal(msg.Data, &data)
+
+	if !reactionKinds[data.Kind] {
+		c.sendError("Unknown reaction")
+		return
+	}
+
+	c.Room.reactionCounts[data.Kind]++
+}
+
+// flushReactions broadcasts the counts collected in the current window and
+// adds them to the movie's timeline totals
+func (room *Room) flushReactions() {
+	if len(room.reactionCounts) == 0 {
+		return
+	}
+
+	counts := room.reactionCounts
+	room.reactionCounts = make(map[string]int)
+	pos := room.position()
+
+	msg := Message{
+		Type:   MessageTypeReactions,
+		RoomID: room.ID,
+		Data: mustMarshal(ReactionsData{
+			Counts:   counts,
+			Position: pos,
+		}),
+		Timestamp: time.Now(),
+	}
+	room.broadcast(mustMarshal(msg))
+
+	if room.MovieID != "" && room.CustomVideoURL == "" {
+		recordReactions(room.MovieID, pos, counts)
+	}
+}
+
+// movieReactions returns a movie's reaction totals, loading them from the
+// store on first use. The caller must hold reactionsMutex.
+func movieReactions(movieID string) map[int]map[string]int {
+	totals, ok := reactionTotals[movieID]
+	if ok {
+		return totals
+	}
+
+	totals = make(map[int]map[string]int)
+	if store != nil {
+		if err := store.Get("reactions", movieID, &totals); err != nil && err != errNotFound {
+			log.Printf("Failed to load reactions for movie %s: %v", movieID, err)
+		}
+	}
+	reactionTotals[movieID] = totals
+	return totals
+}
+
+// recordReactions adds reaction counts to the movie's bucket at the given position
+func recordReactions(movieID string, pos float64, counts map[string]int) {
+	bucket := int(pos) / reactionBucketSeconds
+
+	reactionsMutex.Lock()
+	defer reactionsMutex.Unlock()
+
+	totals := movieReactions(movieID)
+	if totals[bucket] == nil {
+		totals[bucket] = make(map[string]int)
+	}
+	for kind, n := range counts {
+		totals[bucket][kind] += n
+	}
+	reactionDirty[movieID] = true
+}
+
+// StartReactionFlush starts a background goroutine that persists reaction totals
+func StartReactionFlush() {
+	if store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	go func() {
+		for range ticker.C {
+			flushReactionTotals()
+		}
+	}()
+}
+
+// flushReactionTotals persists the dirty reaction totals. They are copied
+// under reactionsMutex and written after it is released, so rooms recording
+// reactions never wait on disk.
+func flushReactionTotals() {
+	reactionsMutex.Lock()
+	dirty := make(map[string]map[int]map[string]int, len(reactionDirty))
+	for movieID := range reactionDirty {
+		totals := make(map[int]map[string]int, len(reactionTotals[movieID]))
+		for bucket, counts := range reactionTotals[movieID] {
+			copied := make(map[string]int, len(counts))
+			for kind, n := range counts {
+				copied[kind] = n
+			}
+			totals[bucket] = copied
+		}
+		dirty[movieID] = totals
+		delete(reactionDirty, movieID)
+	}
+	reactionsMutex.Unlock()
+
+	for movieID, totals := range dirty {
+		if err := store.Put("reactions", movieID, totals); err != nil {
+			log.Printf("Failed to persist reactions for movie %s: %v", movieID, err)
+			reactionsMutex.Lock()
+			reactionDirty[movieID] = true
+			reactionsMutex.Unlock()
+		}
+	}
+}
+
+// GetReactionHeatmap returns a movie's reaction totals per timeline bucket
+func GetReactionHeatmap(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	movieID := params["id"]
+
+	if !findMovie(movieID) {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	}
+
+	reactionsMutex.Lock()
+	totals := movieReactions(movieID)
+	buckets := make([]ReactionBucket, 0, len(totals))
+	for index, counts := range totals {
+		bucket := ReactionBucket{
+			Offset: float64(index * reactionBucketSeconds),
+			Counts: make(map[string]int, len(counts)),
+		}
+		for kind, n := range counts {
+			bucket.Counts[kind] = n
+			bucket.Total += n
+		}
+		buckets = append(buckets, bucket)
+	}
+	reactionsMutex.Unlock()
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Offset < buckets[j].Offset
+	})
+
+	// ?top=N returns only the N most reacted moments
+	if top, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && top > 0 && top < len(buckets) {
+		sort.SliceStable(buckets, func(i, j int) bool {
+			return buckets[i].Total > buckets[j].Total
+		})
+		buckets = buckets[:top]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// TestFlushReactionTotals checks dirty reaction totals reach the store and
+// are no longer dirty afterwards
+func TestFlushReactionTotals(t *testing.T) {
+	useTestStore(t)
+	t.Cleanup(func() {
+		reactionsMutex.Lock()
+		delete(reactionTotals, "m1")
+		delete(reactionDirty, "m1")
+		reactionsMutex.Unlock()
+	})
+
+	recordReactions("m1", 12, map[string]int{"heart": 2})
+	flushReactionTotals()
+	recordReactions("m1", 12, map[string]int{"heart": 1})
+
+	var stored map[int]map[string]int
+	if err := store.Get("reactions", "m1", &stored); err != nil {
+		t.Fatalf("read reactions: %v", err)
+	}
+	if n := stored[2]["heart"]; n != 2 {
+		t.Fatalf("stored %d hearts in bucket 2, want 2", n)
+	}
+
+	reactionsMutex.Lock()
+	dirty := reactionDirty["m1"]
+	reactionsMutex.Unlock()
+	if !dirty {
+		t.Fatal("reactions recorded after the flush are not dirty")
+	}
+}
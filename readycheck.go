@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultReadyCheckSeconds = 30
+	minReadyCheckSeconds     = 5
+	maxReadyCheckSeconds     = 120
+	// playCountdownSeconds is the length of the 3-2-1 countdown before a group play
+	playCountdownSeconds = 3
+)
+
+// handleReadyMessage processes ready-check requests and answers from a client
+func (c *Client) handleReadyMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypeReadyCheck:
+		if !c.isHost() {
+			c.sendError("Only the host can start a ready check")
+			return
+		}
+
+		var data ReadyCheckData
+		json.Unmarshal(msg.Data, &data)
+
+		if room.ReadyCheck != nil {
+			c.sendError("A ready check is already in progress")
+			return
+		}
+		room.cancelPlayCountdown()
+
+		seconds := data.TimeoutSeconds
+		if seconds <= 0 {
+			seconds = defaultReadyCheckSeconds
+		}
+		if seconds < minReadyCheckSeconds {
+			seconds = minReadyCheckSeconds
+		}
+		if seconds > maxReadyCheckSeconds {
+			seconds = maxReadyCheckSeconds
+		}
+		timeout := time.Duration(seconds) * time.Second
+
+		check := &ReadyCheck{
+			ID:        uuid.New().String()[:8],
+			StartedBy: c.Username,
+			ExpiresAt: time.Now().Add(timeout),
+			responses: map[string]bool{c.ID: true},
+		}
+		check.timer = time.AfterFunc(timeout, func() {
+			room.do(func() { room.expireReadyCheck(check.ID) })
+		})
+		room.ReadyCheck = check
+
+		log.Printf("Room %s: %s started ready check %s", room.ID, c.Username, check.ID)
+		room.tallyReadyCheck()
+
+	case MessageTypeReady:
+		var data ReadyData
+		json.Unmarshal(msg.Data, &data)
+
+		if room.ReadyCheck == nil || room.ReadyCheck.ID != data.CheckID {
+			c.sendError("Ready check not found or already closed")
+			return
+		}
+
+		room.ReadyCheck.responses[c.ID] = data.Ready
+		room.tallyReadyCheck()
+	}
+}
+
+// tallyReadyCheck sorts the clients in the room by their answer, broadcasts
+// the tally and starts the countdown once everyone is ready
+func (room *Room) tallyReadyCheck() {
+	check := room.ReadyCheck
+	check.Ready, check.NotReady, check.Pending = []UserInfo{}, []UserInfo{}, []UserInfo{}
+	for client := range room.Clients {
+		if client.Role == RoleSpectator {
+			continue
+		}
+		user := UserInfo{ID: client.ID, Username: client.Username}
+		ready, answered := check.responses[client.ID]
+		switch {
+		case !answered:
+			check.Pending = append(check.Pending, user)
+		case ready:
+			check.Ready = append(check.Ready, user)
+		default:
+			check.NotReady = append(check.NotReady, user)
+		}
+	}
+	for _, users := range [][]UserInfo{check.Ready, check.NotReady, check.Pending} {
+		sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	}
+
+	room.broadcast(mustMarshal(Message{
+		Type:      MessageTypeReadyUpdate,
+		RoomID:    room.ID,
+		Data:      mustMarshal(check),
+		Timestamp: time.Now(),
+	}))
+
+	if len(check.Ready) > 0 && len(check.Pending) == 0 && len(check.NotReady) == 0 {
+		room.resolveReadyCheck(true, "")
+	}
+}
+
+// expireReadyCheck closes a ready-check whose timeout ran out
+func (room *Room) expireReadyCheck(checkID string) {
+	if room.ReadyCheck == nil || room.ReadyCheck.ID != checkID {
+		return
+	}
+	room.resolveReadyCheck(false, "expired")
+}
+
+// resolveReadyCheck closes the open ready-check, broadcasts the outcome and
+// starts the play countdown if everyone was ready
+func (room *Room) resolveReadyCheck(allReady bool, reason string) {
+	check := room.ReadyCheck
+	check.timer.Stop()
+	room.ReadyCheck = nil
+
+	room.broadcast(mustMarshal(Message{
+		Type:   MessageTypeReadyResult,
+		RoomID: room.ID,
+		Data: mustMarshal(ReadyResultData{
+			Check:    check,
+			AllReady: allReady,
+			Reason:   reason,
+		}),
+		Timestamp: time.Now(),
+	}))
+
+	log.Printf("Room %s: ready check %s allReady=%v %s", room.ID, check.ID, allReady, reason)
+	if allReady {
+		room.startPlayCountdown()
+	}
+}
+
+// startPlayCountdown schedules a group play playCountdownSeconds from now and
+// counts down to it
+func (room *Room) startPlayCountdown() {
+	room.countdown = &playCountdown{
+		id:     uuid.New().String()[:8],
+		playAt: time.Now().Add(playCountdownSeconds * time.Second),
+	}
+	room.tickPlayCountdown(room.countdown.id)
+}
+
+// tickPlayCountdown broadcasts the seconds left before the countdown's play,
+// or starts playback once playAt is reached
+func (room *Room) tickPlayCountdown(id string) {
+	countdown := room.countdown
+	if countdown == nil || countdown.id != id {
+		return
+	}
+
+	left := int(math.Ceil(time.Until(countdown.playAt).Seconds()))
+	if left <= 0 {
+		room.countdown = nil
+		room.playAt(countdown.playAt)
+		return
+	}
+
+	room.broadcast(mustMarshal(Message{
+		Type:   MessageTypePlayCountdown,
+		RoomID: room.ID,
+		Data: mustMarshal(PlayCountdownData{
+			PlayAt:      countdown.playAt,
+			CurrentTime: room.VideoState.CurrentTime,
+			SecondsLeft: left,
+		}),
+		Timestamp: time.Now(),
+	}))
+
+	// Fire on the next whole second before playAt
+	next := countdown.playAt.Add(-time.Duration(left-1) * time.Second)
+	countdown.timer = time.AfterFunc(time.Until(next), func() {
+		room.do(func() { room.tickPlayCountdown(id) })
+	})
+}
+
+// cancelPlayCountdown stops a pending countdown, for example when someone
+// plays, pauses or seeks before it ends
+func (room *Room) cancelPlayCountdown() {
+	countdown := room.countdown
+	if countdown == nil {
+		return
+	}
+	if countdown.timer != nil {
+		countdown.timer.Stop()
+	}
+	room.countdown = nil
+
+	room.broadcast(mustMarshal(Message{
+		Type:   MessageTypePlayCountdown,
+		RoomID: room.ID,
+		Data: mustMarshal(PlayCountdownData{
+			PlayAt:      countdown.playAt,
+			CurrentTime: room.VideoState.CurrentTime,
+			Cancelled:   true,
+		}),
+		Timestamp: time.Now(),
+	}))
+}
+
+// playAt starts playback for everyone at the agreed server time
+func (room *Room) playAt(at time.Time) {
+	room.VideoState.IsPlaying = true
+	room.VideoState.LastUpdateBy = "countdown"
+	room.VideoState.UpdatedAt = at
+	room.markDirty()
+
+	room.broadcast(mustMarshal(Message{
+		Type:     MessageTypePlay,
+		RoomID:   room.ID,
+		Username: "countdown",
+		Data: mustMarshal(PlayPauseData{
+			CurrentTime: room.VideoState.CurrentTime,
+			PlayAt:      &at,
+		}),
+		Timestamp: time.Now(),
+	}))
+	log.Printf("Room %s: countdown play at %.2f", room.ID, room.VideoState.CurrentTime)
+}
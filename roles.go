@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Client roles
+const (
+	RoleParticipant = "participant"
+	RoleSpectator   = "spectator"
+)
+
+// spectatorMessages are the message types a spectator may still send. They
+// can join the call and answer WebRTC offers to receive streams but not
+// offer their own.
+var spectatorMessages = map[string]bool{
+	MessageTypeLeave:        true,
+	MessageTypeReaction:     true,
+	MessageTypeMediaJoin:    true,
+	MessageTypeMediaLeave:   true,
+	MessageTypeAnswer:       true,
+	MessageTypeIceCandidate: true,
+}
+
+// spectatorChatMessages are allowed for spectators when the room enables spectator chat
+var spectatorChatMessages = map[string]bool{
+	MessageTypeChat:       true,
+	MessageTypeChatEdit:   true,
+	MessageTypeChatDelete: true,
+	MessageTypeChatReact:  true,
+	MessageTypeTyping:     true,
+}
+
+func validRole(role string) bool {
+	return role == RoleParticipant || role == RoleSpectator
+}
+
+// inviteToken returns the invite token that joins the room with role. Tokens
+// are signed with the host token, so they need no storage and are accepted
+// by every node.
+func (room *Room) inviteToken(role string) string {
+	mac := hmac.New(sha256.New, []byte(room.HostToken))
+	mac.Write([]byte(room.ID + ":" + role))
+	return role + "." + hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// inviteRole returns the role an invite token grants, or "" if the token is
+// not valid for this room
+func (room *Room) inviteRole(token string) string {
+	role, _, ok := strings.Cut(token, ".")
+	if !ok || !validRole(role) {
+		return ""
+	}
+	if !hmac.Equal([]byte(token), []byte(room.inviteToken(role))) {
+		return ""
+	}
+	return role
+}
+
+// joinRole picks the role of a new connection: the host always participates,
+// an invite token decides for invited users and the room settings for the rest
+func (room *Room) joinRole(isHost bool, invite string) string {
+	// Nobody may control a replay, which plays the recording for everyone
+	if room.ReplayOf != "" {
+		return RoleSpectator
+	}
+	if isHost {
+		return RoleParticipant
+	}
+	if role := room.inviteRole(invite); role != "" {
+		return role
+	}
+	return room.Snapshot().Info.Settings.DefaultRole
+}
+
+// canSend reports whether the client's role allows sending a message type
+func (c *Client) canSend(msgType string) bool {
+	if c.Role != RoleSpectator {
+		return true
+	}
+	if spectatorChatMessages[msgType] {
+		return c.Room.Settings.SpectatorChat
+	}
+	return spectatorMessages[msgType]
+}
+
+// participantCount returns how many clients on this node are not spectators
+func (room *Room) participantCount() int {
+	count := 0
+	for client := range room.Clients {
+		if client.Role != RoleSpectator {
+			count++
+		}
+	}
+	return count
+}
+
+// listed reports whether a user with role appears in the user list broadcast.
+// Hidden spectators still count towards presence.
+func (room *Room) listed(role string) bool {
+	return role != RoleSpectator || !room.Settings.HideSpectators
+}
+
+// handleRoleMessage lets the host promote a spectator or demote a participant
+func (c *Client) handleRoleMessage(msg Message) {
+	room := c.Room
+
+	if !c.isHost() {
+		c.sendError("Only the host can change roles")
+		return
+	}
+
+	var data RoleData
+	json.Unmarshal(msg.Data, &data)
+
+	if !validRole(data.Role) {
+		c.sendError("Unknown role")
+		return
+	}
+	if data.UserID == room.HostID {
+		c.sendError("The host's role cannot be changed")
+		return
+	}
+
+	// The user may be connected to another node, so look across the room
+	found := false
+	for _, user := range room.presence() {
+		if user.ID == data.UserID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.sendError("User not found")
+		return
+	}
+
+	room.applyRole(data.UserID, data.Role)
+	// Demoted users stop publishing; they can rejoin the call to receive
+	if peer := room.Media[data.UserID]; data.Role == RoleSpectator && peer != nil && peer.publishing() {
+		room.mediaLeave(data.UserID)
+	}
+	room.broadcast(mustMarshal(Message{
+		Type:      MessageTypeRole,
+		RoomID:    room.ID,
+		UserID:    c.ID,
+		Username:  c.Username,
+		Data:      mustMarshal(data),
+		Timestamp: time.Now(),
+	}))
+	room.broadcastUserList()
+
+	log.Printf("Room %s: %s made %s a %s", room.ID, c.Username, data.UserID, data.Role)
+}
+
+// applyRole changes the role of this node's connections and sessions for a user
+func (room *Room) applyRole(userID, role string) {
+	for client := range room.Clients {
+		if client.ID == userID {
+			client.Role = role
+		}
+	}
+
+	room.sessionsMutex.Lock()
+	for _, session := range room.Sessions {
+		if session.ClientID == userID {
+			session.Role = role
+		}
+	}
+	room.sessionsMutex.Unlock()
+}
+
+// CreateInvite returns an invite token that joins the room with a role.
+// Only the host may create invites.
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if !room.isHostToken(r.Header.Get("X-Host-Token")) {
+		http.Error(w, "Only the host can create invites", http.StatusForbidden)
+		return
+	}
+
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !validRole(req.Role) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	resp := CreateInviteResponse{
+		Role:        req.Role,
+		InviteToken: room.inviteToken(req.Role),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
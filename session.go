@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// resumeGracePeriod is how long a disconnected client can reclaim its identity
+	resumeGracePeriod = 2 * time.Minute
+	// historySize is how many recent broadcasts each room keeps for replay
+	historySize = 256
+)
+
+// bufferedMessage is a broadcast message tagged with its room sequence number
+type bufferedMessage struct {
+	Seq  uint64
+	Data []byte
+}
+
+// messageRing is a fixed-size ring buffer of recent room broadcasts
+type messageRing struct {
+	items []bufferedMessage
+	next  int
+	seq   uint64
+}
+
+func newMessageRing(size int) *messageRing {
+	return &messageRing{items: make([]bufferedMessage, size)}
+}
+
+// push stores a message and returns its sequence number
+func (r *messageRing) push(data []byte) uint64 {
+	r.seq++
+	r.items[r.next] = bufferedMessage{Seq: r.seq, Data: data}
+	r.next = (r.next + 1) % len(r.items)
+	return r.seq
+}
+
+// since returns the buffered messages newer than seq, oldest first
+func (r *messageRing) since(seq uint64) []bufferedMessage {
+	var out []bufferedMessage
+	for i := 0; i < len(r.items); i++ {
+		item := r.items[(r.next+i)%len(r.items)]
+		if item.Data != nil && item.Seq > seq {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// claimSession returns the session for a resume token if it is still within
+// the grace window, marking it connected. It returns nil otherwise.
+func (room *Room) claimSession(token string) *Session {
+	room.sessionsMutex.Lock()
+	defer room.sessionsMutex.Unlock()
+
+	session, ok := room.Sessions[token]
+	if !ok {
+		return nil
+	}
+	if !session.Connected && time.Since(session.DisconnectedAt) > resumeGracePeriod {
+		delete(room.Sessions, token)
+		return nil
+	}
+
+	session.Connected = true
+	return session
+}
+
+// resumable reports whether a resume token names a session that can still be claimed
+func (room *Room) resumable(token string) bool {
+	room.sessionsMutex.Lock()
+	defer room.sessionsMutex.Unlock()
+
+	session, ok := room.Sessions[token]
+	return ok && (session.Connected || time.Since(session.DisconnectedAt) <= resumeGracePeriod)
+}
+
+// newSession issues a resume token for a newly joined client
+func (room *Room) newSession(clientID, username, role string) *Session {
+	session := &Session{
+		Token:     uuid.New().String(),
+		ClientID:  clientID,
+		Username:  username,
+		Role:      role,
+		Connected: true,
+	}
+
+	room.sessionsMutex.Lock()
+	room.Sessions[session.Token] = session
+	room.sessionsMutex.Unlock()
+
+	return session
+}
+
+// attachSession marks a resumed session connected again, in case the old
+// connection's unregister was processed after the session was claimed
+func (room *Room) attachSession(session *Session) {
+	room.sessionsMutex.Lock()
+	session.Connected = true
+	room.sessionsMutex.Unlock()
+}
+
+// detachSession marks a client's session as disconnected so it can be
+// resumed from the last broadcast its connection wrote. It returns false if
+// the client left for good and the session was removed.
+func (room *Room) detachSession(client *Client) bool {
+	room.sessionsMutex.Lock()
+	defer room.sessionsMutex.Unlock()
+
+	session := client.Session
+	if client.Left {
+		delete(room.Sessions, session.Token)
+		return false
+	}
+
+	session.Connected = false
+	session.DisconnectedAt = time.Now()
+	session.LastSeq = client.lastSeq.Load()
+	return true
+}
+
+// expireSessions removes disconnected sessions past the grace window and
+// reports whether any were removed
+func (room *Room) expireSessions() bool {
+	room.sessionsMutex.Lock()
+	defer room.sessionsMutex.Unlock()
+
+	expired := false
+	for token, session := range room.Sessions {
+		if !session.Connected && time.Since(session.DisconnectedAt) > resumeGracePeriod {
+			delete(room.Sessions, token)
+			log.Printf("Session for %s in room %s expired", session.Username, room.ID)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// awayUsers returns users whose sessions are disconnected but still resumable
+func (room *Room) awayUsers() []UserInfo {
+	room.sessionsMutex.Lock()
+	defer room.sessionsMutex.Unlock()
+
+	users := make([]UserInfo, 0)
+	for _, session := range room.Sessions {
+		if !session.Connected {
+			users = append(users, UserInfo{
+				ID:       session.ClientID,
+				Username: session.Username,
+				Role:     session.Role,
+			})
+		}
+	}
+	return users
+}
+
+// dropStaleConnections removes older connections that share a resumed client's ID
+func (room *Room) dropStaleConnections(client *Client) {
+	for other := range room.Clients {
+		if other != client && other.ID == client.ID {
+			// The old connection may not have been noticed as dead yet; resume
+			// from what it actually wrote
+			client.Session.LastSeq = other.lastSeq.Load()
+			delete(room.Clients, other)
+			close(other.Send)
+			log.Printf("Replaced stale connection for %s in room %s", other.Username, room.ID)
+		}
+	}
+}
+
+// written records that a connection wrote a message, so a resumed session
+// replays only the broadcasts after it. It is called by the client's writer.
+func (c *Client) written(out outgoing) {
+	if out.seq > 0 {
+		c.lastSeq.Store(out.seq)
+	}
+}
+
+// sendSession sends the client its identity and resume token, followed by any
+// broadcasts it missed while disconnected
+func (room *Room) sendSession(client *Client) {
+	var missed []bufferedMessage
+	if client.Resumed {
+		missed = room.History.since(client.Session.LastSeq)
+	}
+
+	msg := Message{
+		Type:   MessageTypeSession,
+		RoomID: room.ID,
+		UserID: client.ID,
+		Data: mustMarshal(SessionData{
+			UserID:      client.ID,
+			ResumeToken: client.Session.Token,
+			Role:        client.Role,
+			Resumed:     client.Resumed,
+			Replayed:    len(missed),
+		}),
+		Timestamp: time.Now(),
+	}
+
+	client.send(mustMarshal(msg))
+	for _, item := range missed {
+		f := newFrame(item.Data)
+		f.seq = item.Seq
+		client.enqueue(f)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readUntil reads messages until one of msgType arrives
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		var msg Message
+		json.Unmarshal(data, &msg)
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func resumeRoom(t *testing.T, serverURL, roomID, token string) *websocket.Conn {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(serverURL, "http") + "/api/rooms/" + roomID + "/ws?resumeToken=" + url.QueryEscape(token)
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	return conn
+}
+
+func TestResumeReplaysOnlyUnwrittenBroadcasts(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	a, err := dialRoom(t, server, room.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session SessionData
+	json.Unmarshal(readUntil(t, a, MessageTypeSession).Data, &session)
+
+	b, err := dialRoom(t, server, room.ID, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// a receives these over its live connection
+	b.WriteMessage(websocket.TextMessage, []byte(`{"type":"play","data":{"currentTime":1}}`))
+	b.WriteMessage(websocket.TextMessage, []byte(`{"type":"pause","data":{"currentTime":2}}`))
+	readUntil(t, a, MessageTypePause)
+
+	// Reconnecting before the old socket is noticed as dead replays nothing
+	a2 := resumeRoom(t, server.URL, room.ID, session.ResumeToken)
+	var resumed SessionData
+	json.Unmarshal(readUntil(t, a2, MessageTypeSession).Data, &resumed)
+	if !resumed.Resumed || resumed.Replayed != 0 {
+		t.Fatalf("early resume: resumed=%v replayed=%d, want true, 0", resumed.Resumed, resumed.Replayed)
+	}
+	a.Close()
+
+	// Broadcasts made while disconnected are replayed once
+	a2.Close()
+	time.Sleep(100 * time.Millisecond)
+	b.WriteMessage(websocket.TextMessage, []byte(`{"type":"seek","data":{"time":30}}`))
+	b.WriteMessage(websocket.TextMessage, []byte(`{"type":"seek","data":{"time":40}}`))
+	readUntil(t, b, MessageTypeSeek)
+	readUntil(t, b, MessageTypeSeek)
+
+	a3 := resumeRoom(t, server.URL, room.ID, session.ResumeToken)
+	defer a3.Close()
+	json.Unmarshal(readUntil(t, a3, MessageTypeSession).Data, &resumed)
+	if resumed.Replayed != 2 {
+		t.Fatalf("replayed %d messages, want 2", resumed.Replayed)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// sfuPeerID is the peer rooms in SFU mode exchange offers, answers and ICE
+// candidates with, in the to and userId fields of signaling messages
+const sfuPeerID = "sfu"
+
+// roomSFU forwards the media of a room's call through the server, so every
+// client uploads its camera and microphone once. Its methods are called from
+// the room's Run goroutine.
+type roomSFU interface {
+	// join adds a client to the call, or updates what it publishes
+	join(client *Client, audio, video bool) error
+	// leave removes a user and stops forwarding their tracks
+	leave(userID string)
+	// signal handles an answer or ICE candidate from a client
+	signal(client *Client, msg Message) error
+	close()
+}
+
+var (
+	// Set by builds with the sfu tag, which include pion/webrtc
+	openSFU    func() error
+	newRoomSFU func(room *Room) roomSFU
+
+	sfuEnabled bool
+
+	errSFUUnavailable = errors.New("This server does not support SFU calls")
+)
+
+// ConfigureSFU enables the built-in SFU when SFU_ENABLED is true. The server
+// must be built with -tags sfu.
+func ConfigureSFU() error {
+	if os.Getenv("SFU_ENABLED") != "true" {
+		return nil
+	}
+	if openSFU == nil {
+		return errors.New("SFU_ENABLED needs a server built with -tags sfu")
+	}
+	if err := openSFU(); err != nil {
+		return err
+	}
+	sfuEnabled = true
+	return nil
+}
+
+// joinSFU adds a client to the room's SFU call, starting the SFU on first use
+func (room *Room) joinSFU(client *Client, audio, video bool) error {
+	if !sfuEnabled {
+		return errSFUUnavailable
+	}
+	if room.sfu == nil {
+		room.sfu = newRoomSFU(room)
+	}
+	return room.sfu.join(client, audio, video)
+}
@@ -0,0 +1,457 @@
+//go:build sfu
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeInterval is how often publishers are asked for a keyframe, so new
+// subscribers do not wait long for a picture
+const keyframeInterval = 3 * time.Second
+
+var sfuAPI *webrtc.API
+
+func init() {
+	openSFU = openPionSFU
+	newRoomSFU = newPionSFU
+}
+
+// openPionSFU sets up the WebRTC stack shared by every room. SFU_PUBLIC_IP
+// advertises the host's public address when it sits behind 1:1 NAT, and
+// SFU_UDP_PORT serves all calls on a single UDP port.
+func openPionSFU() error {
+	settings := webrtc.SettingEngine{}
+	if ip := os.Getenv("SFU_PUBLIC_IP"); ip != "" {
+		settings.SetNAT1To1IPs([]string{ip}, webrtc.ICECandidateTypeHost)
+	}
+	if v := os.Getenv("SFU_UDP_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid SFU_UDP_PORT %q", v)
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			return err
+		}
+		settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return err
+	}
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return err
+	}
+
+	sfuAPI = webrtc.NewAPI(
+		webrtc.WithMediaEngine(media),
+		webrtc.WithInterceptorRegistry(interceptors),
+		webrtc.WithSettingEngine(settings),
+	)
+	log.Printf("SFU enabled")
+	return nil
+}
+
+// pionSFU is a room's selective forwarding unit. The server offers each
+// client one audio and one video slot to publish into and adds every other
+// publisher's tracks to its connection, renegotiating as tracks come and go.
+type pionSFU struct {
+	room   *Room
+	mu     sync.Mutex
+	peers  map[string]*sfuPeer  // By user ID
+	tracks map[string]*sfuTrack // By owner and track ID
+}
+
+// sfuPeer is one client's connection to the SFU
+type sfuPeer struct {
+	userID       string
+	client       *Client
+	pc           *webrtc.PeerConnection
+	audio, video bool // What the client may publish
+	offerPending bool // Tracks changed while an offer was outstanding
+
+	mu     sync.Mutex
+	out    chan []byte // Signaling for the client, delivered in order
+	closed bool
+}
+
+// sfuTrack is a published track forwarded to the other peers
+type sfuTrack struct {
+	owner string
+	local *webrtc.TrackLocalStaticRTP
+}
+
+func newPionSFU(room *Room) roomSFU {
+	return &pionSFU{
+		room:   room,
+		peers:  make(map[string]*sfuPeer),
+		tracks: make(map[string]*sfuTrack),
+	}
+}
+
+func (s *pionSFU) join(client *Client, audio, video bool) error {
+	// Rejoining with the same media keeps a working connection. Anything else
+	// starts over, so the tracks forwarded match what the client may publish.
+	s.mu.Lock()
+	if peer, ok := s.peers[client.ID]; ok && peer.client == client && peer.audio == audio && peer.video == video {
+		switch peer.pc.ConnectionState() {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		default:
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.mu.Unlock()
+	s.leave(client.ID)
+
+	config := webrtc.Configuration{}
+	if len(stunServers) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: stunServers}}
+	}
+	pc, err := sfuAPI.NewPeerConnection(config)
+	if err != nil {
+		log.Printf("Room %s: SFU connection for %s failed: %v", s.room.ID, client.Username, err)
+		return errors.New("Could not start the call")
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			pc.Close()
+			return errors.New("Could not start the call")
+		}
+	}
+
+	peer := &sfuPeer{
+		userID: client.ID,
+		client: client,
+		pc:     pc,
+		audio:  audio,
+		video:  video,
+		out:    make(chan []byte, 64),
+	}
+	go peer.deliver()
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		init := candidate.ToJSON()
+		index := int(*init.SDPMLineIndex)
+		peer.send(MessageTypeIceCandidate, IceCandidateData{
+			Candidate:     init.Candidate,
+			SDPMid:        init.SDPMid,
+			SDPMLineIndex: &index,
+		})
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state != webrtc.PeerConnectionStateFailed {
+			return
+		}
+		s.mu.Lock()
+		current := s.peers[client.ID] == peer
+		s.mu.Unlock()
+		if !current {
+			pc.Close()
+			return
+		}
+
+		// A failed connection leaves the call, unless the user rejoined meanwhile
+		s.leave(client.ID)
+		room := s.room
+		room.do(func() {
+			s.mu.Lock()
+			_, rejoined := s.peers[client.ID]
+			s.mu.Unlock()
+			if !rejoined {
+				room.mediaLeave(client.ID)
+			}
+		})
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		s.forward(peer, remote)
+	})
+
+	s.mu.Lock()
+	s.peers[client.ID] = peer
+	s.offer(peer)
+	s.mu.Unlock()
+
+	log.Printf("Room %s: %s connected to the SFU", s.room.ID, client.Username)
+	return nil
+}
+
+func (s *pionSFU) leave(userID string) {
+	s.mu.Lock()
+	peer, ok := s.peers[userID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.peers, userID)
+	for key, track := range s.tracks {
+		if track.owner == userID {
+			delete(s.tracks, key)
+		}
+	}
+	s.renegotiate()
+	s.mu.Unlock()
+
+	peer.close()
+}
+
+func (s *pionSFU) signal(client *Client, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peers[client.ID]
+	if !ok || peer.client != client {
+		return errors.New("Join the call with mediaJoin before signaling")
+	}
+
+	switch msg.Type {
+	case MessageTypeAnswer:
+		var data SessionDescriptionData
+		json.Unmarshal(msg.Data, &data)
+		err := peer.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: data.SDP})
+		if err != nil {
+			return errors.New("The answer does not match the SFU's offer")
+		}
+		// Send the changes that arrived while the last offer was outstanding
+		if peer.offerPending {
+			s.offer(peer)
+		}
+
+	case MessageTypeIceCandidate:
+		var data IceCandidateData
+		json.Unmarshal(msg.Data, &data)
+		if data.Candidate == "" {
+			return nil
+		}
+		candidate := webrtc.ICECandidateInit{
+			Candidate:        data.Candidate,
+			SDPMid:           data.SDPMid,
+			UsernameFragment: data.UsernameFragment,
+		}
+		if data.SDPMLineIndex != nil {
+			index := uint16(*data.SDPMLineIndex)
+			candidate.SDPMLineIndex = &index
+		}
+		if err := peer.pc.AddICECandidate(candidate); err != nil {
+			return errors.New("Invalid ICE candidate")
+		}
+
+	default:
+		return errors.New("The SFU sends offers; reply with an answer")
+	}
+	return nil
+}
+
+func (s *pionSFU) close() {
+	s.mu.Lock()
+	peers := s.peers
+	s.peers = make(map[string]*sfuPeer)
+	s.tracks = make(map[string]*sfuTrack)
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.close()
+	}
+}
+
+// forward relays a published track to every other peer until the publisher
+// stops sending it
+func (s *pionSFU) forward(peer *sfuPeer, remote *webrtc.TrackRemote) {
+	s.mu.Lock()
+	allowed := s.peers[peer.userID] == peer &&
+		((remote.Kind() == webrtc.RTPCodecTypeAudio && peer.audio) ||
+			(remote.Kind() == webrtc.RTPCodecTypeVideo && peer.video))
+	if !allowed {
+		s.mu.Unlock()
+		// Drain what the client sends anyway without forwarding it
+		for {
+			if _, _, err := remote.ReadRTP(); err != nil {
+				return
+			}
+		}
+	}
+
+	// The stream ID tells subscribers whose track it is
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), peer.userID)
+	if err != nil {
+		s.mu.Unlock()
+		log.Printf("Room %s: SFU track for %s failed: %v", s.room.ID, peer.userID, err)
+		return
+	}
+	key := peer.userID + "/" + remote.ID()
+	track := &sfuTrack{owner: peer.userID, local: local}
+	s.tracks[key] = track
+	s.renegotiate()
+	s.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		go peer.requestKeyframes(remote, stop)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			break
+		}
+		if _, err := local.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	if s.tracks[key] == track {
+		delete(s.tracks, key)
+		s.renegotiate()
+	}
+	s.mu.Unlock()
+}
+
+// renegotiate sends an offer to every peer whose set of forwarded tracks
+// changed. The caller holds s.mu.
+func (s *pionSFU) renegotiate() {
+	for _, peer := range s.peers {
+		if s.syncTracks(peer) {
+			s.offer(peer)
+		}
+	}
+}
+
+// syncTracks adds the tracks a peer is missing and removes the ones that
+// ended, reporting whether anything changed. The caller holds s.mu.
+func (s *pionSFU) syncTracks(peer *sfuPeer) bool {
+	changed := false
+	sending := make(map[string]bool)
+
+	for _, sender := range peer.pc.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		key := track.StreamID() + "/" + track.ID()
+		if _, ok := s.tracks[key]; ok {
+			sending[key] = true
+			continue
+		}
+		if err := peer.pc.RemoveTrack(sender); err == nil {
+			changed = true
+		}
+	}
+
+	for key, track := range s.tracks {
+		if track.owner == peer.userID || sending[key] {
+			continue
+		}
+		if _, err := peer.pc.AddTrack(track.local); err == nil {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// offer sends a peer a new offer, or defers it until the client answers the
+// one outstanding. The caller holds s.mu.
+func (s *pionSFU) offer(peer *sfuPeer) {
+	if peer.pc.SignalingState() != webrtc.SignalingStateStable {
+		peer.offerPending = true
+		return
+	}
+	peer.offerPending = false
+
+	offer, err := peer.pc.CreateOffer(nil)
+	if err == nil {
+		err = peer.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("Room %s: SFU offer to %s failed: %v", s.room.ID, peer.userID, err)
+		return
+	}
+	peer.send(MessageTypeOffer, SessionDescriptionData{Type: MessageTypeOffer, SDP: offer.SDP})
+}
+
+// send queues a signaling message from the SFU for the client
+func (p *sfuPeer) send(msgType string, data interface{}) {
+	msg := mustMarshal(Message{
+		Type:      msgType,
+		RoomID:    p.client.Room.ID,
+		UserID:    sfuPeerID,
+		To:        p.userID,
+		Data:      mustMarshal(data),
+		Timestamp: time.Now(),
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.out <- msg:
+	default:
+		log.Printf("Room %s: SFU signaling for %s dropped (queue full)", p.client.Room.ID, p.userID)
+	}
+}
+
+// deliver hands queued signaling to the room, which owns the client's Send channel
+func (p *sfuPeer) deliver() {
+	room := p.client.Room
+	for msg := range p.out {
+		data := msg
+		room.do(func() {
+			if room.Clients[p.client] {
+				p.client.send(data)
+			}
+		})
+	}
+}
+
+// requestKeyframes asks the publisher for a keyframe periodically until stop is closed
+func (p *sfuPeer) requestKeyframes(remote *webrtc.TrackRemote, stop chan struct{}) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}}); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *sfuPeer) close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.out)
+	}
+	p.mu.Unlock()
+
+	if err := p.pc.Close(); err != nil {
+		log.Printf("SFU connection close for %s: %v", p.userID, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Share kinds
+const (
+	ShareKindScreen = "screen" // A screen or window capture
+	ShareKindFile   = "file"   // A local file the broadcaster plays
+)
+
+const (
+	maxShareTitle    = 200 // characters
+	maxShareStreamID = 64
+)
+
+// handleShareMessage starts or stops the room's live share. The broadcaster
+// publishes the stream through the call, so they must be in it with video.
+func (c *Client) handleShareMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypeShareStart:
+		if !c.canControl() {
+			c.sendError("Only the host can share in this room")
+			return
+		}
+
+		var data ShareStartData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid share")
+			return
+		}
+		if data.Kind != ShareKindScreen && data.Kind != ShareKindFile {
+			c.sendError("Share kind must be screen or file")
+			return
+		}
+		title := sanitizeText(data.Title)
+		if utf8.RuneCountInString(title) > maxShareTitle || len(data.StreamID) > maxShareStreamID {
+			c.sendError("Invalid share")
+			return
+		}
+
+		if room.Share != nil && room.Share.OwnerID != c.ID {
+			c.sendError(room.Share.OwnerName + " is already sharing")
+			return
+		}
+		if peer := room.Media[c.ID]; peer == nil || !peer.Video {
+			c.sendError("Join the call with video to share")
+			return
+		}
+
+		share := &Share{
+			ID:        uuid.New().String()[:8],
+			OwnerID:   c.ID,
+			OwnerName: c.Username,
+			Kind:      data.Kind,
+			Title:     title,
+			StreamID:  data.StreamID,
+			StartedAt: time.Now(),
+		}
+		if room.Share != nil {
+			// Restarting keeps the video state saved by the first start
+			share.ID = room.Share.ID
+		}
+		room.startShare(share)
+
+		log.Printf("Room %s: %s started a %s share", room.ID, c.Username, data.Kind)
+
+	case MessageTypeShareStop:
+		if room.Share == nil {
+			c.sendError("Nothing is being shared")
+			return
+		}
+		if room.Share.OwnerID != c.ID && !c.isHost() {
+			c.sendError("Only the broadcaster or the host can stop the share")
+			return
+		}
+		room.stopShare("stopped by " + c.Username)
+	}
+}
+
+// startShare makes share the room's live stream. The playback position is
+// kept aside and the video state turns live, which disables seeking.
+func (room *Room) startShare(share *Share) {
+	room.applyShareStart(share)
+	room.markDirty()
+
+	room.broadcast(mustMarshal(Message{
+		Type:      MessageTypeShareStart,
+		RoomID:    room.ID,
+		UserID:    share.OwnerID,
+		Username:  share.OwnerName,
+		Data:      mustMarshal(share),
+		Timestamp: time.Now(),
+	}))
+	room.broadcast(mustMarshal(room.syncMessage()))
+}
+
+// applyShareStart records a share started on this or another node
+func (room *Room) applyShareStart(share *Share) {
+	if room.shareResume == nil {
+		saved := *room.VideoState
+		room.shareResume = &saved
+	}
+	room.Share = share
+
+	room.VideoState = &VideoState{
+		IsPlaying:    true,
+		Live:         true,
+		LastUpdateBy: share.OwnerName,
+		UpdatedAt:    time.Now(),
+	}
+}
+
+// stopShare ends the live share and returns everyone to the paused video
+// where it was when the share started
+func (room *Room) stopShare(reason string) {
+	share := room.Share
+	if share == nil {
+		return
+	}
+	room.applyShareStop()
+	room.markDirty()
+
+	room.broadcast(mustMarshal(Message{
+		Type:      MessageTypeShareStop,
+		RoomID:    room.ID,
+		UserID:    share.OwnerID,
+		Username:  share.OwnerName,
+		Data:      mustMarshal(ShareStopData{ShareID: share.ID, Reason: reason}),
+		Timestamp: time.Now(),
+	}))
+	room.broadcast(mustMarshal(room.syncMessage()))
+
+	log.Printf("Room %s: share by %s ended (%s)", room.ID, share.OwnerName, reason)
+}
+
+// applyShareStop clears a share stopped on this or another node
+func (room *Room) applyShareStop() {
+	room.Share = nil
+	if room.shareResume != nil {
+		room.VideoState = room.shareResume
+		room.VideoState.IsPlaying = false
+		room.VideoState.UpdatedAt = time.Now()
+		room.shareResume = nil
+	}
+}
+
+// applyRemoteShare updates the replica from another node's shareStart or shareStop
+func (room *Room) applyRemoteShare(msg Message) {
+	if msg.Type == MessageTypeShareStart {
+		var share Share
+		json.Unmarshal(msg.Data, &share)
+		room.applyShareStart(&share)
+	} else {
+		room.applyShareStop()
+	}
+}
+
+// savedVideoState returns the video state to persist: the paused video
+// behind a live share, which ends if the room restarts
+func (room *Room) savedVideoState() *VideoState {
+	if room.shareResume != nil {
+		return room.shareResume
+	}
+	return room.VideoState
+}
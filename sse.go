@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment line, so
+// proxies do not time it out
+const sseKeepAlive = 25 * time.Second
+
+var (
+	// streamClients maps resume tokens to the clients connected over an
+	// event stream, which post their messages separately
+	streamClients      = make(map[string]*Client)
+	streamClientsMutex sync.Mutex
+)
+
+// HandleEventStream joins a room over Server-Sent Events, for browsers and
+// networks without WebSockets. Each event carries one JSON room message;
+// the client sends its own messages with PostStreamMessage.
+func HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+	username := r.URL.Query().Get("username")
+
+	if username == "" {
+		username = "Anonymous"
+	}
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	// 204 stops EventSource from reconnecting, so a stream whose session has
+	// ended does not come back as a new user
+	if token, _ := lastEventID(r); token != "" && !room.resumable(token) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client := room.newClient(r, username, nil)
+	if !room.register(client) {
+		http.Error(w, "Room closed", http.StatusGone)
+		return
+	}
+
+	token := client.Session.Token
+	streamClientsMutex.Lock()
+	streamClients[token] = client
+	streamClientsMutex.Unlock()
+
+	defer func() {
+		streamClientsMutex.Lock()
+		if streamClients[token] == client {
+			delete(streamClients, token)
+		}
+		streamClientsMutex.Unlock()
+		room.unregister(client)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx response buffering
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	// EventSource reconnects after this many milliseconds
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	for {
+		var err error
+		select {
+		case out, ok := <-client.Send:
+			rc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				fmt.Fprintf(w, "event: close\ndata: %s\n\n", mustMarshal(client.closeData()))
+				flusher.Flush()
+				return
+			}
+			// The id lets a reconnecting EventSource resume the session from
+			// the last broadcast it received
+			seq := out.seq
+			if seq == 0 {
+				seq = client.lastSeq.Load()
+			}
+			if _, err = fmt.Fprintf(w, "id: %s:%d\ndata: %s\n\n", token, seq, out.data); err == nil {
+				client.written(out)
+			}
+
+		case <-keepAlive.C:
+			rc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			_, err = io.WriteString(w, ": keepalive\n\n")
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// closeData mirrors the WebSocket close frame for clients without one. It is
+// read once the client's Send channel is closed.
+func (c *Client) closeData() CloseData {
+	code := c.closeCode
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	return CloseData{Code: code, Reason: c.closeReason}
+}
+
+// lastEventID reads the Last-Event-ID header of a reconnecting EventSource:
+// the stream's resume token and the last broadcast it received
+func lastEventID(r *http.Request) (string, uint64) {
+	token, last, ok := strings.Cut(r.Header.Get("Last-Event-ID"), ":")
+	if !ok {
+		return "", 0
+	}
+	seq, err := strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return token, seq
+}
+
+// PostStreamMessage handles a message from an event stream or long-poll
+// client. The body
+// is one JSON message, as sent over a WebSocket; the X-Resume-Token header
+// identifies the stream. Replies and errors arrive on the stream.
+func PostStreamMessage(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	roomID := params["id"]
+
+	room, exists := lookupRoom(roomID)
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	streamClientsMutex.Lock()
+	client := streamClients[r.Header.Get("X-Resume-Token")]
+	streamClientsMutex.Unlock()
+	if client == nil || client.Room != room {
+		http.Error(w, "No event stream or long poll open for this token", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageBytes))
+	if err != nil {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	select {
+	case room.Inbound <- clientMessage{client: client, data: body}:
+	case <-room.done:
+		http.Error(w, "Room closed", http.StatusGone)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
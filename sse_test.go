@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// openStream opens an event stream, sending lastEventID if it is set
+func openStream(t *testing.T, url, lastEventID string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	return resp
+}
+
+// readStreamUntil reads events until a message of msgType, returning it and its event id
+func readStreamUntil(t *testing.T, r *bufio.Reader, msgType string) (Message, string) {
+	t.Helper()
+	var id string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if v, ok := strings.CutPrefix(line, "id: "); ok {
+			id = v
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var msg Message
+			json.Unmarshal([]byte(data), &msg)
+			if msg.Type == msgType {
+				return msg, id
+			}
+		}
+	}
+}
+
+// TestEventStreamResumesFromLastEventID checks a reconnecting EventSource
+// keeps its identity and gets the broadcasts it missed
+func TestEventStreamResumesFromLastEventID(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+	streamURL := server.URL + "/api/rooms/" + room.ID + "/stream?username=tv"
+
+	resp := openStream(t, streamURL, "")
+	stream := bufio.NewReader(resp.Body)
+	sessionMsg, _ := readStreamUntil(t, stream, MessageTypeSession)
+	var session SessionData
+	json.Unmarshal(sessionMsg.Data, &session)
+
+	alice, err := dialRoom(t, server, room.ID, "alice")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer alice.Close()
+	_, lastID := readStreamUntil(t, stream, MessageTypeUserList)
+	if !strings.HasPrefix(lastID, session.ResumeToken+":") {
+		t.Fatalf("event id %q does not carry the resume token", lastID)
+	}
+
+	// The stream drops, and a broadcast happens before it reconnects
+	resp.Body.Close()
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"play","data":{"currentTime":5}}`))
+	readUntil(t, alice, MessageTypePlay)
+
+	resp = openStream(t, streamURL, lastID)
+	stream = bufio.NewReader(resp.Body)
+	resumedMsg, _ := readStreamUntil(t, stream, MessageTypeSession)
+	var resumed SessionData
+	json.Unmarshal(resumedMsg.Data, &resumed)
+	if !resumed.Resumed || resumed.UserID != session.UserID {
+		t.Fatalf("reconnect joined as %+v, want a resume of %s", resumed, session.UserID)
+	}
+	readStreamUntil(t, stream, MessageTypePlay)
+
+	// After leaving for good, a reconnect is told to stop
+	req, _ := http.NewRequest("POST", server.URL+"/api/rooms/"+room.ID+"/stream", strings.NewReader(`{"type":"leave"}`))
+	req.Header.Set("X-Resume-Token", session.ResumeToken)
+	if posted, err := http.DefaultClient.Do(req); err == nil {
+		posted.Body.Close()
+	}
+	for {
+		if _, err := stream.ReadString('\n'); err != nil {
+			break
+		}
+	}
+	resp.Body.Close()
+
+	resp = openStream(t, streamURL, lastID)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reconnect after leaving: status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// errNotFound is returned by Store.Get when a document does not exist
+var errNotFound = errors.New("not found")
+
+// Store persists JSON documents and append-only JSON Lines logs, grouped by
+// collection and key
+type Store interface {
+	Put(collection, key string, v interface{}) error
+	Get(collection, key string, v interface{}) error
+	Delete(collection, key string) error
+	Keys(collection string) ([]string, error)
+	Append(collection, key string, v interface{}) error
+	RewriteLog(collection, key string, lines []interface{}) error
+	ReadLog(collection, key string, fn func(line []byte) error) error
+}
+
+// store is the persistent data store, or nil when persistence is disabled
+var store Store
+
+// storeWrites queues writes to the store, so Run never waits on disk.
+// writeStore performs them in order.
+var storeWrites = make(chan func(), 4096)
+
+// writeStore performs queued store writes until the process exits
+func writeStore() {
+	for write := range storeWrites {
+		write()
+	}
+}
+
+// queueStoreWrite queues a write to a collection's key, dropping it if the
+// writer has fallen too far behind. It reports whether the write was queued.
+func queueStoreWrite(collection, key string, write func()) bool {
+	select {
+	case storeWrites <- write:
+		return true
+	default:
+		log.Printf("Store writer behind, dropped a write to %s/%s", collection, key)
+		return false
+	}
+}
+
+var startStoreWriter sync.Once
+
+// StartStoreWriter starts the goroutine that performs queued store writes
+func StartStoreWriter() {
+	startStoreWriter.Do(func() { go writeStore() })
+}
+
+// flushStoreWrites waits until the store writes queued so far are done
+func flushStoreWrites() {
+	done := make(chan struct{})
+	storeWrites <- func() { close(done) }
+	<-done
+}
+
+// OpenStore configures the persistent store from the DATA_DIR environment
+// variable. Persistence stays disabled when it is unset.
+func OpenStore() error {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	fs, err := newFileStore(dir)
+	if err != nil {
+		return err
+	}
+	store = fs
+	return nil
+}
+
+var safeKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// fileStore keeps each document in <dir>/<collection>/<key>.json and each log
+// in <dir>/<collection>/<key>.jsonl
+type fileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create data dir: %v", err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(collection, key, ext string) (string, error) {
+	if !safeKeyPattern.MatchString(collection) || !safeKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid store key %q/%q", collection, key)
+	}
+	return filepath.Join(s.dir, collection, key+ext), nil
+}
+
+// Put writes a document, replacing any previous version atomically
+func (s *fileStore) Put(collection, key string, v interface{}) error {
+	path, err := s.path(collection, key, ".json")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get reads a document into v
+func (s *fileStore) Get(collection, key string, v interface{}) error {
+	path, err := s.path(collection, key, ".json")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	data, err := os.ReadFile(path)
+	s.mu.Unlock()
+
+	if os.IsNotExist(err) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Delete removes a document and its log, if any
+func (s *fileStore) Delete(collection, key string) error {
+	path, err := s.path(collection, key, ".json")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range []string{path, path + "l"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys lists the document keys in a collection
+func (s *fileStore) Keys(collection string) ([]string, error) {
+	if !safeKeyPattern.MatchString(collection) {
+		return nil, fmt.Errorf("invalid store collection %q", collection)
+	}
+
+	s.mu.Lock()
+	entries, err := os.ReadDir(filepath.Join(s.dir, collection))
+	s.mu.Unlock()
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, ".json") {
+			keys = append(keys, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	return keys, nil
+}
+
+// Append adds one JSON line to a log
+func (s *fileStore) Append(collection, key string, v interface{}) error {
+	path, err := s.path(collection, key, ".jsonl")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// RewriteLog replaces a log with the given lines atomically
+func (s *fileStore) RewriteLog(collection, key string, lines []interface{}) error {
+	path, err := s.path(collection, key, ".jsonl")
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, v := range lines {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadLog calls fn for each line of a log, oldest first. A missing log is empty.
+func (s *fileStore) ReadLog(collection, key string, fn func(line []byte) error) error {
+	path, err := s.path(collection, key, ".jsonl")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	data, err := os.ReadFile(path)
+	s.mu.Unlock()
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Vote actions
+const (
+	VoteActionSkip = "skip"
+	VoteActionSeek = "seek"
+)
+
+const (
+	defaultVoteThreshold     = 0.5
+	defaultVoteWindowSeconds = 30
+)
+
+// normalizeRoomSettings fills in defaults for missing or out-of-range settings
+func normalizeRoomSettings(settings *RoomSettings) *RoomSettings {
+	if settings == nil {
+		settings = &RoomSettings{}
+	}
+	if settings.VoteThreshold <= 0 || settings.VoteThreshold > 1 {
+		settings.VoteThreshold = defaultVoteThreshold
+	}
+	if settings.VoteWindowSeconds <= 0 {
+		settings.VoteWindowSeconds = defaultVoteWindowSeconds
+	}
+	// Zero idle settings fall back to the server policy
+	if settings.IdleTimeoutSeconds < 0 {
+		settings.IdleTimeoutSeconds = 0
+	}
+	if settings.CleanupIntervalSeconds < 0 {
+		settings.CleanupIntervalSeconds = 0
+	}
+	if !validRole(settings.DefaultRole) {
+		settings.DefaultRole = RoleParticipant
+	}
+	if settings.MaxPublishers <= 0 {
+		settings.MaxPublishers = defaultMaxPublishers
+	}
+	if settings.MaxPublishers > maxMaxPublishers {
+		settings.MaxPublishers = maxMaxPublishers
+	}
+	return settings
+}
+
+// votesRequired returns how many yes votes pass a proposal with the current participants
+func (room *Room) votesRequired() int {
+	required := int(math.Ceil(room.Settings.VoteThreshold * float64(room.participantCount())))
+	if required < 1 {
+		required = 1
+	}
+	return required
+}
+
+// handleVoteMessage processes vote proposals and ballots from a client
+func (c *Client) handleVoteMessage(msg Message) {
+	room := c.Room
+
+	switch msg.Type {
+	case MessageTypeVotePropose:
+		var data VoteProposeData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			c.sendError("Invalid vote proposal")
+			return
+		}
+
+		if room.Share != nil {
+			c.sendError("Votes are disabled during a live share")
+			return
+		}
+
+		switch data.Action {
+		case VoteActionSkip:
+			if len(room.Queue) == 0 {
+				c.sendError("Queue is empty")
+				return
+			}
+		case VoteActionSeek:
+			if !validTime(data.Time) {
+				c.sendError("Invalid seek time")
+				return
+			}
+		default:
+			c.sendError("Unknown vote action")
+			return
+		}
+
+		if room.Proposal != nil {
+			c.sendError("A vote is already in progress")
+			return
+		}
+
+		window := time.Duration(room.Settings.VoteWindowSeconds) * time.Second
+		proposal := &VoteProposal{
+			ID:         uuid.New().String()[:8],
+			Action:     data.Action,
+			Time:       data.Time,
+			ProposedBy: c.Username,
+			ExpiresAt:  time.Now().Add(window),
+			votes:      map[string]bool{c.ID: true},
+		}
+		proposal.timer = time.AfterFunc(window, func() {
+			room.do(func() { room.expireProposal(proposal.ID) })
+		})
+		room.Proposal = proposal
+
+		log.Printf("Room %s: %s proposed vote %s (%s)", room.ID, c.Username, proposal.ID, proposal.Action)
+		room.tallyProposal()
+
+	case MessageTypeVote:
+		var data VoteData
+		json.Unmarshal(msg.Data, &data)
+
+		if room.Proposal == nil || room.Proposal.ID != data.ProposalID {
+			c.sendError("Vote not found or already closed")
+			return
+		}
+
+		room.Proposal.votes[c.ID] = data.Approve
+		room.tallyProposal()
+	}
+}
+
+// tallyProposal recounts the open proposal, broadcasts the tally and resolves
+// it once the outcome is decided
+func (room *Room) tallyProposal() {
+	proposal := room.Proposal
+	proposal.Yes, proposal.No = 0, 0
+	for _, approve := range proposal.votes {
+		if approve {
+			proposal.Yes++
+		} else {
+			proposal.No++
+		}
+	}
+	proposal.Required = room.votesRequired()
+
+	room.broadcast(mustMarshal(Message{
+		Type:      MessageTypeVoteUpdate,
+		RoomID:    room.ID,
+		Data:      mustMarshal(proposal),
+		Timestamp: time.Now(),
+	}))
+
+	switch {
+	case proposal.Yes >= proposal.Required:
+		room.resolveProposal(true, "")
+	case room.participantCount()-proposal.No < proposal.Required:
+		room.resolveProposal(false, "rejected")
+	}
+}
+
+// expireProposal closes a proposal whose voting window ran out
+func (room *Room) expireProposal(proposalID string) {
+	if room.Proposal == nil || room.Proposal.ID != proposalID {
+		return
+	}
+	room.resolveProposal(false, "expired")
+}
+
+// resolveProposal closes the open proposal, broadcasts the outcome and runs
+// the action if it passed
+func (room *Room) resolveProposal(passed bool, reason string) {
+	proposal := room.Proposal
+	proposal.timer.Stop()
+	room.Proposal = nil
+
+	if passed && room.Share != nil {
+		passed, reason = false, "a live share started"
+	}
+
+	room.broadcast(mustMarshal(Message{
+		Type:   MessageTypeVoteResult,
+		RoomID: room.ID,
+		Data: mustMarshal(VoteResultData{
+			Proposal: proposal,
+			Passed:   passed,
+			Reason:   reason,
+		}),
+		Timestamp: time.Now(),
+	}))
+
+	log.Printf("Room %s: vote %s (%s) passed=%v %s", room.ID, proposal.ID, proposal.Action, passed, reason)
+	if !passed {
+		return
+	}
+
+	switch proposal.Action {
+	case VoteActionSkip:
+		room.advanceQueue("vote", room.VideoState.IsPlaying)
+
+	case VoteActionSeek:
+		room.VideoState.CurrentTime = proposal.Time
+		room.VideoState.LastUpdateBy = "vote"
+		room.VideoState.UpdatedAt = time.Now()
+		room.markDirty()
+
+		room.broadcast(mustMarshal(Message{
+			Type:      MessageTypeSeek,
+			RoomID:    room.ID,
+			Username:  "vote",
+			Data:      mustMarshal(SeekData{Time: proposal.Time}),
+			Timestamp: time.Now(),
+		}))
+	}
+}
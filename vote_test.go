@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestLeavingClientBallotIsDropped checks a client that leaves no longer
+// counts towards the open vote, and the vote is re-tallied without it
+func TestLeavingClientBallotIsDropped(t *testing.T) {
+	server := newTestServer(t)
+	room := createTestRoom(t, server)
+
+	conns := make(map[string]*websocket.Conn)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		conn, err := dialRoom(t, server, room.ID, name)
+		if err != nil {
+			t.Fatalf("dial %s: %v", name, err)
+		}
+		defer conn.Close()
+		readUntil(t, conn, MessageTypeSync)
+		conns[name] = conn
+	}
+	alice := conns["alice"]
+	nextUpdate := func() VoteProposal {
+		t.Helper()
+		var proposal VoteProposal
+		json.Unmarshal(readUntil(t, alice, MessageTypeVoteUpdate).Data, &proposal)
+		return proposal
+	}
+
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"votePropose","data":{"action":"seek","time":60}}`))
+	proposal := nextUpdate()
+	vote := []byte(`{"type":"vote","data":{"proposalId":"` + proposal.ID + `","approve":false}}`)
+	conns["bob"].WriteMessage(websocket.TextMessage, vote)
+	nextUpdate()
+	conns["carol"].WriteMessage(websocket.TextMessage, vote)
+	if proposal = nextUpdate(); proposal.No != 2 {
+		t.Fatalf("tally after two no votes: %+v", proposal)
+	}
+
+	// Without bob's ballot, one no vote of three cannot reject the seek
+	conns["bob"].Close()
+	if proposal = nextUpdate(); proposal.Yes != 1 || proposal.No != 1 || proposal.Required != 2 {
+		t.Fatalf("tally after bob left: %+v", proposal)
+	}
+
+	conns["dave"].WriteMessage(websocket.TextMessage, []byte(`{"type":"vote","data":{"proposalId":"`+proposal.ID+`","approve":true}}`))
+	var result VoteResultData
+	json.Unmarshal(readUntil(t, alice, MessageTypeVoteResult).Data, &result)
+	if !result.Passed {
+		t.Fatalf("vote did not pass: %+v", result)
+	}
+}